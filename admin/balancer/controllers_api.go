@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/trendrr/goshire-shards/shards"
 	"github.com/trendrr/goshire/cheshire"
+	"github.com/trendrr/goshire/dynmap"
 	clog "github.com/trendrr/goshire/log"
 	"log"
 	"time"
@@ -14,8 +15,18 @@ func init() {
 	cheshire.RegisterApi("/api/service", "GET", ServiceGet)
 	cheshire.RegisterApi("/api/service/update", "GET", ServiceUpdate)
 	cheshire.RegisterApi("/api/service/rebalance", "POST", ServiceRebalance)
+	cheshire.RegisterApi("/api/service/split", "POST", ServiceSplit)
+	cheshire.RegisterApi("/api/service/diff", "GET", ServiceDiff)
+	cheshire.RegisterApi("/api/service/validate", "GET", ServiceValidate)
+	cheshire.RegisterApi("/api/service/revisions", "GET", ServiceRevisions)
+	cheshire.RegisterApi("/api/service/revision", "GET", ServiceRevision)
+	cheshire.RegisterApi("/api/service/rollback", "POST", ServiceRollback)
+	cheshire.RegisterApi("/api/service/transfer", "GET", ServiceTransfer)
+	cheshire.RegisterApi("/api/service/transfer", "POST", ServiceTransferUpdate)
 	cheshire.RegisterApi("/api/service/sub/checkins", "GET", ServiceCheckins)
 	cheshire.RegisterApi("/api/shard/new", "PUT", ShardNew)
+	cheshire.RegisterApi("/api/shard/update", "POST", ShardUpdate)
+	cheshire.RegisterApi("/api/shard/state", "POST", ShardState)
 }
 
 func ServiceGet(txn *cheshire.Txn) {
@@ -30,6 +41,144 @@ func ServiceGet(txn *cheshire.Txn) {
 	txn.Write(res)
 }
 
+// Shows the changes between two revisions of the router table
+// params:
+// service => the service name
+// to => the newer revision (defaults to the current revision)
+// from => the older revision (defaults to the revision before to)
+func ServiceDiff(txn *cheshire.Txn) {
+	service := txn.Params().MustString("service", "")
+	routerTable, ok := Servs.RouterTable(service)
+	if !ok {
+		cheshire.SendError(txn, 406, "Service param missing or service not found")
+		return
+	}
+
+	to, ok := Servs.RouterTableRevision(service, txn.Params().MustInt64("to", routerTable.Revision))
+	if !ok {
+		cheshire.SendError(txn, 404, "to revision not found")
+		return
+	}
+
+	var from *shards.RouterTable
+	rev, ok := txn.Params().GetInt64("from")
+	if ok {
+		from, ok = Servs.RouterTableRevision(service, rev)
+	} else {
+		from, ok = Servs.PreviousRouterTable(service, to.Revision)
+	}
+	if !ok {
+		cheshire.SendError(txn, 404, "from revision not found")
+		return
+	}
+
+	res := cheshire.NewResponse(txn)
+	res.Put("diff", from.Diff(to).ToDynMap())
+	txn.Write(res)
+}
+
+// Lints a router table.  Validates the router_table param if present, otherwise the
+// current table for the service.
+// response:
+// {
+//  "valid" : true if there are no errors,
+//  "problems" : [{"severity" : "warning", "message" : "..."}]
+// }
+func ServiceValidate(txn *cheshire.Txn) {
+	var problems []*shards.Problem
+	mp, ok := txn.Params().GetDynMap("router_table")
+	if ok {
+		_, problems = shards.ValidateDynMap(mp)
+	} else {
+		routerTable, ok := Servs.RouterTable(txn.Params().MustString("service", ""))
+		if !ok {
+			cheshire.SendError(txn, 406, "Service param missing or service not found")
+			return
+		}
+		problems = routerTable.Validate()
+	}
+
+	p := make([]*dynmap.DynMap, 0)
+	for _, problem := range problems {
+		p = append(p, problem.ToDynMap())
+	}
+	res := cheshire.NewResponse(txn)
+	res.Put("valid", !shards.HasErrors(problems))
+	res.Put("problems", p)
+	txn.Write(res)
+}
+
+// Lists all the revisions of the router table, oldest first
+func ServiceRevisions(txn *cheshire.Txn) {
+	service := txn.Params().MustString("service", "")
+	_, ok := Servs.RouterTable(service)
+	if !ok {
+		cheshire.SendError(txn, 406, "Service param missing or service not found")
+		return
+	}
+	tables, err := Servs.History(service)
+	if err != nil {
+		cheshire.SendError(txn, 501, fmt.Sprintf("Error reading history %s", err))
+		return
+	}
+	revisions := make([]*dynmap.DynMap, 0)
+	for _, t := range tables {
+		revisions = append(revisions, revisionSummary(t))
+	}
+	res := cheshire.NewResponse(txn)
+	res.Put("revisions", revisions)
+	txn.Write(res)
+}
+
+// summary of a single router table revision
+func revisionSummary(table *shards.RouterTable) *dynmap.DynMap {
+	mp := dynmap.New()
+	mp.Put("revision", table.Revision)
+	mp.Put("total_partitions", table.TotalPartitions)
+	mp.Put("replication_factor", table.ReplicationFactor)
+	mp.Put("entries", len(table.Entries))
+	return mp
+}
+
+// Gets a single revision of the router table
+func ServiceRevision(txn *cheshire.Txn) {
+	revision, ok := txn.Params().GetInt64("revision")
+	if !ok {
+		cheshire.SendError(txn, 406, "revision param missing")
+		return
+	}
+	routerTable, ok := Servs.RouterTableRevision(txn.Params().MustString("service", ""), revision)
+	if !ok {
+		cheshire.SendError(txn, 404, "Revision not found")
+		return
+	}
+	res := cheshire.NewResponse(txn)
+	res.Put("router_table", routerTable.ToDynMap())
+	txn.Write(res)
+}
+
+// Publishes an old revision as a new revision, and pushes it to all the entries.
+// Note that no data is moved.
+func ServiceRollback(txn *cheshire.Txn) {
+	revision, ok := txn.Params().GetInt64("revision")
+	if !ok {
+		cheshire.SendError(txn, 406, "revision param missing")
+		return
+	}
+	routerTable, err := Servs.Rollback(txn.Params().MustString("service", ""), revision)
+	if err != nil {
+		cheshire.SendError(txn, 406, fmt.Sprintf("Unable to rollback %s", err))
+		return
+	}
+	routerTable, ok = RouterTableUpdate(Servs, routerTable, len(routerTable.Entries))
+	if !ok {
+		Servs.Logger.Printf("Uh oh, Didnt update any router tables")
+	}
+	res := cheshire.NewResponse(txn)
+	res.Put("router_table", routerTable.ToDynMap())
+	txn.Write(res)
+}
+
 // Updates the router table on all entries
 func ServiceUpdate(txn *cheshire.Txn) {
 	log.Println("Service checkin registered")
@@ -72,7 +221,7 @@ func ServiceCheckins(txn *cheshire.Txn) {
 	for {
 
 		for _, e := range routerTable.Entries {
-			err := EntryContact(e)
+			err := EntryContactMember(e)
 			if err != nil {
 				Servs.Logger.Printf("Error contacting %s -- %s", e.Id(), err)
 				continue
@@ -105,7 +254,12 @@ func ServiceCheckins(txn *cheshire.Txn) {
 }
 
 // Handles the rebalance operation.
-// will push an updated router table everytime it changes.
+// will push an updated router table everytime it changes, and
+// the "progress" of each partition copy while it runs.
+// params:
+// service => the service name
+// max => the max number of partitions to move (default 1)
+// restart => if true, copies start over instead of resuming from an earlier failed copy
 func ServiceRebalance(txn *cheshire.Txn) {
 	routerTable, ok := Servs.RouterTable(txn.Params().MustString("service", ""))
 	if !ok {
@@ -113,9 +267,41 @@ func ServiceRebalance(txn *cheshire.Txn) {
 		return
 	}
 
+	//stream the copy progress while partitions move
+	progress := make(chan *shards.TransferProgress, 10)
+	Servs.ListenProgress(progress)
+	defer Servs.UnlistenProgress(progress)
+
 	maxPartition := txn.Params().MustInt("max", 1)
+	restart := txn.Params().MustBool("restart", false)
 	for i := 0; i < maxPartition; i++ {
-		err := RebalanceSingle(Servs, routerTable)
+		//every move changes the table, so plan from the current one
+		routerTable, ok = Servs.RouterTable(routerTable.Service)
+		if !ok {
+			cheshire.SendError(txn, 406, "Problem finding router table")
+			return
+		}
+		table := routerTable
+		done := make(chan error, 1)
+		go func() {
+			done <- RebalanceSingle(Servs, table, restart)
+		}()
+		var err error
+		moving := true
+		for moving {
+			select {
+			case p := <-progress:
+				if p.Service != routerTable.Service {
+					continue
+				}
+				res := cheshire.NewResponse(txn)
+				res.SetTxnContinue()
+				res.Put("progress", p.ToDynMap())
+				txn.Write(res)
+			case err = <-done:
+				moving = false
+			}
+		}
 		if err != nil {
 			Servs.Logger.Printf("ERROR %s", err)
 			cheshire.SendError(txn, 501, "Problem rebalancing")
@@ -124,13 +310,89 @@ func ServiceRebalance(txn *cheshire.Txn) {
 		res := cheshire.NewResponse(txn)
 		res.SetTxnContinue()
 		//Write the new router table.
+		routerTable, _ = Servs.RouterTable(routerTable.Service)
 		res.Put("router_table", routerTable.ToDynMap())
 
 		txn.Write(res)
 		time.Sleep(3 * time.Second)
 	}
-	
-	
+}
+
+// Gets the transfer settings used when moving partitions for a service
+// params:
+// service => the service name
+func ServiceTransfer(txn *cheshire.Txn) {
+	routerTable, ok := Servs.RouterTable(txn.Params().MustString("service", ""))
+	if !ok {
+		cheshire.SendError(txn, 406, "Service param missing or service not found")
+		return
+	}
+	res := cheshire.NewResponse(txn)
+	res.Put("transfer", Servs.TransferSettings(routerTable.Service).ToDynMap())
+	txn.Write(res)
+}
+
+// Sets the transfer settings used when moving partitions for a service
+// params:
+// service => the service name
+// compression => gzip, snappy or empty for none
+// rate => max bytes per second for each copy, 0 is unlimited
+func ServiceTransferUpdate(txn *cheshire.Txn) {
+	routerTable, ok := Servs.RouterTable(txn.Params().MustString("service", ""))
+	if !ok {
+		cheshire.SendError(txn, 406, "Service param missing or service not found")
+		return
+	}
+	settings, err := ToTransferSettings(txn.Params())
+	if err != nil {
+		cheshire.SendError(txn, 406, fmt.Sprintf("%s", err))
+		return
+	}
+	err = Servs.SetTransferSettings(routerTable.Service, settings)
+	if err != nil {
+		cheshire.SendError(txn, 501, fmt.Sprintf("Unable to save transfer settings %s", err))
+		return
+	}
+	Servs.Logger.Printf("Transfers for %s are now compression '%s', rate %d bytes/sec", routerTable.Service, settings.Compression, settings.Rate)
+	res := cheshire.NewResponse(txn)
+	res.Put("transfer", settings.ToDynMap())
+	txn.Write(res)
+}
+
+// Grows the number of partitions for a service
+// params:
+// service => the service name
+// factor => multiply the partitions by this (default 2)
+// retry => if true, only split the entries that failed to split last time
+func ServiceSplit(txn *cheshire.Txn) {
+	routerTable, ok := Servs.RouterTable(txn.Params().MustString("service", ""))
+	if !ok {
+		cheshire.SendError(txn, 406, "Service param missing or service not found")
+		return
+	}
+
+	if txn.Params().MustBool("retry", false) {
+		routerTable, err := ResplitEntries(Servs, routerTable)
+		if err != nil {
+			Servs.Logger.Printf("ERROR %s", err)
+			cheshire.SendError(txn, 501, fmt.Sprintf("Problem splitting partitions %s", err))
+			return
+		}
+		res := cheshire.NewResponse(txn)
+		res.Put("router_table", routerTable.ToDynMap())
+		txn.Write(res)
+		return
+	}
+
+	routerTable, err := SplitPartitions(Servs, routerTable, txn.Params().MustInt("factor", 2))
+	if err != nil {
+		Servs.Logger.Printf("ERROR %s", err)
+		cheshire.SendError(txn, 501, fmt.Sprintf("Problem splitting partitions %s", err))
+		return
+	}
+	res := cheshire.NewResponse(txn)
+	res.Put("router_table", routerTable.ToDynMap())
+	txn.Write(res)
 }
 
 // Gets any logging messages from the Servs.Events
@@ -158,6 +420,7 @@ func ConsoleLog(txn *cheshire.Txn) {
 
 // Creates a new shard.  Does not register any partitions to it, unless the router table has no entries. in which case this
 // gets all the partitions
+// If the node is already in the table (same node id) the address and ports are updated in place.
 func ShardNew(txn *cheshire.Txn) {
 	routerTable, ok := Servs.RouterTable(txn.Params().MustString("service", ""))
 
@@ -197,20 +460,39 @@ func ShardNew(txn *cheshire.Txn) {
 		JsonPort:   jsonPort,
 		HttpPort:   httpPort,
 		BinPort: binPort,
+		Zone:       txn.Params().MustString("zone", ""),
+		Weight:     txn.Params().MustInt("weight", 1),
 		Partitions: make([]int, 0),
 	}
 
 	//check if we can connect!
 	Servs.Logger.Printf("Attempting to connect to new entry...")
-	err := EntryContact(entry)
+	nodeId, err := EntryContact(entry)
 	if err != nil {
 		Servs.Logger.Printf("ERROR: ", err)
 		cheshire.SendError(txn, 406, fmt.Sprintf("Unable to contact %s:%d Error(%s)", entry.Address, entry.HttpPort, err))
 		return
 	}
 	Servs.Logger.Printf("Success!")
+	entry.NodeId = nodeId
 
-	if len(routerTable.Entries) == 0 {
+	existing, ok := routerTable.FindEntry(entry.Id())
+	if !ok {
+		//entries from before node ids are keyed on the address
+		existing, ok = routerTable.FindEntry(entry.AddressId())
+	}
+	if ok {
+		// this node is already in the table, this is an update of the address/ports
+		Servs.Logger.Printf("Entry %s already exists, updating in place", existing.Id())
+		entry.Partitions = existing.Partitions
+		entry.State = existing.State
+		if !txn.Params().Exists("zone") {
+			entry.Zone = existing.Zone
+		}
+		if !txn.Params().Exists("weight") {
+			entry.Weight = existing.Weight
+		}
+	} else if len(routerTable.Entries) == 0 {
 		totalPartitions := routerTable.TotalPartitions
 
 		//first entry, giving it all the partitions
@@ -230,10 +512,13 @@ func ShardNew(txn *cheshire.Txn) {
 		return
 	}
 
+	err = Servs.SetRouterTable(routerTable)
+	if err != nil {
+		cheshire.SendError(txn, 406, fmt.Sprintf("Error on add entry %s", err))
+		return
+	}
 	Servs.Logger.Printf("Successfully created new entry: %s", entry.Id())
 
-	Servs.SetRouterTable(routerTable)
-
 	Servs.Logger.Printf("Attempting to sending new router table to entry")
 	_, _, _, err = EntryCheckin(routerTable, entry)
 
@@ -247,3 +532,97 @@ func ShardNew(txn *cheshire.Txn) {
 	res.Put("router_table", routerTable.ToDynMap())
 	txn.Write(res)
 }
+
+// Updates an existing shard.  Currently only the weight can be changed.
+// setting the weight to 0 will drain the entry on the next rebalances
+// params:
+// service => the service name
+// entry => the entry id
+// weight => the new weight
+func ShardUpdate(txn *cheshire.Txn) {
+	routerTable, ok := Servs.RouterTable(txn.Params().MustString("service", ""))
+	if !ok {
+		cheshire.SendError(txn, 406, "Service param missing or service not found")
+		return
+	}
+
+	entry, ok := routerTable.FindEntry(txn.Params().MustString("entry", ""))
+	if !ok {
+		cheshire.SendError(txn, 406, "entry param missing or entry not found")
+		return
+	}
+
+	weight, ok := txn.Params().GetInt("weight")
+	if !ok || weight < 0 {
+		cheshire.SendError(txn, 406, "weight param missing or negative")
+		return
+	}
+
+	updated := *entry
+	updated.Weight = weight
+	routerTable, err := routerTable.AddEntries(&updated)
+	if err != nil {
+		cheshire.SendError(txn, 501, fmt.Sprintf("Error on update entry %s", err))
+		return
+	}
+	err = Servs.SetRouterTable(routerTable)
+	if err != nil {
+		cheshire.SendError(txn, 406, fmt.Sprintf("Error on update entry %s", err))
+		return
+	}
+	Servs.Logger.Printf("Set weight of %s to %d", updated.Id(), weight)
+
+	routerTable, ok = RouterTableUpdate(Servs, routerTable, len(routerTable.Entries))
+	if !ok {
+		Servs.Logger.Printf("Uh oh, Didnt update any router tables")
+	}
+
+	res := cheshire.NewResponse(txn)
+	res.Put("router_table", routerTable.ToDynMap())
+	txn.Write(res)
+}
+
+// Sets the lifecycle state of an entry (joining, active, draining, down).
+// No data is moved, this only changes where requests are routed.
+func ShardState(txn *cheshire.Txn) {
+	routerTable, ok := Servs.RouterTable(txn.Params().MustString("service", ""))
+	if !ok {
+		cheshire.SendError(txn, 406, "Service param missing or service not found")
+		return
+	}
+
+	entry, ok := routerTable.FindEntry(txn.Params().MustString("entry", ""))
+	if !ok {
+		cheshire.SendError(txn, 406, "entry param missing or entry not found")
+		return
+	}
+
+	state := txn.Params().MustString("state", "")
+	if !shards.ValidEntryState(state) {
+		cheshire.SendError(txn, 406, fmt.Sprintf("state param missing or invalid (%s)", state))
+		return
+	}
+
+	updated := *entry
+	updated.State = state
+	routerTable, err := routerTable.AddEntries(&updated)
+	if err != nil {
+		cheshire.SendError(txn, 501, fmt.Sprintf("Error on update entry %s", err))
+		return
+	}
+	err = Servs.SetRouterTable(routerTable)
+	if err != nil {
+		cheshire.SendError(txn, 406, fmt.Sprintf("Error on update entry %s", err))
+		return
+	}
+	Servs.Logger.Printf("Set state of %s from %s to %s", updated.Id(), entry.EntryState(), state)
+
+	routerTable, ok = RouterTableUpdate(Servs, routerTable, len(routerTable.Entries))
+	if !ok {
+		Servs.Logger.Printf("Uh oh, Didnt update any router tables")
+	}
+
+	res := cheshire.NewResponse(txn)
+	res.Put("router_table", routerTable.ToDynMap())
+	txn.Write(res)
+}
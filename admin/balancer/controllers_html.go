@@ -14,6 +14,9 @@ func init() {
 	cheshire.RegisterHtml("/service/new", "POST", NewService)
 	cheshire.RegisterHtml("/service/import", "POST", ImportService)
 	cheshire.RegisterHtml("/service", "GET", Service)
+	cheshire.RegisterHtml("/service/history", "GET", ServiceHistory)
+	cheshire.RegisterHtml("/service/revision", "GET", ServiceRevisionHtml)
+	cheshire.RegisterHtml("/service/rollback", "POST", ServiceRollbackHtml)
 	cheshire.RegisterHtml("/log", "GET", Log)
 }
 
@@ -51,7 +54,12 @@ func ImportService(txn *cheshire.Txn) {
 		cheshire.Redirect(txn, "/index")
 		return
 	}
-	Servs.SetRouterTable(rt)
+	err = Servs.SetRouterTable(rt)
+	if err != nil {
+		cheshire.Flash(txn, "error", fmt.Sprintf("%s", err))
+		cheshire.Redirect(txn, "/index")
+		return
+	}
 	cheshire.Flash(txn, "success", "successfully created router table")
 	cheshire.Redirect(txn, fmt.Sprintf("/service?name=%s", rt.Service))
 }
@@ -70,8 +78,9 @@ func NewService(txn *cheshire.Txn) {
 	if !ok {
 		cheshire.Flash(txn, "error", "Partition keys is manditory")
 	}
+	hashAlgorithm := txn.Params().MustString("hash-algorithm", shards.HASH_MD5_LEGACY)
 	log.Println(partitionKeys)
-	err := Servs.NewRouterTable(name, partitions, replication, partitionKeys)
+	err := Servs.NewRouterTable(name, partitions, replication, partitionKeys, hashAlgorithm)
 	if err != nil {
 		cheshire.Flash(txn, "error", fmt.Sprintf("%s", err))
 		cheshire.Redirect(txn, "/index")
@@ -93,5 +102,72 @@ func Service(txn *cheshire.Txn) {
 		return
 	}
 	context["service"] = service.Service
+	transfer := Servs.TransferSettings(service.Service)
+	context["compression"] = transfer.Compression
+	context["rate"] = transfer.Rate
 	cheshire.RenderInLayout(txn, "/service.html", "/template.html", context)
 }
+
+// Lists the recent revisions of the router table, newest first
+func ServiceHistory(txn *cheshire.Txn) {
+	name := txn.Params().MustString("name", "")
+	current, ok := Servs.RouterTable(name)
+	if !ok {
+		cheshire.Flash(txn, "error", fmt.Sprintf("Cant find service"))
+		cheshire.Redirect(txn, "/index")
+		return
+	}
+	tables, err := Servs.History(name)
+	if err != nil {
+		cheshire.Flash(txn, "error", fmt.Sprintf("%s", err))
+	}
+	revisions := make([]map[string]interface{}, 0)
+	for i := len(tables) - 1; i >= 0; i-- {
+		revision := revisionSummary(tables[i]).Map
+		revision["current"] = tables[i].Revision == current.Revision
+		revisions = append(revisions, revision)
+	}
+	context := make(map[string]interface{})
+	context["service"] = name
+	context["revisions"] = revisions
+	cheshire.RenderInLayout(txn, "/history.html", "/template.html", context)
+}
+
+// Shows a single revision of the router table
+func ServiceRevisionHtml(txn *cheshire.Txn) {
+	name := txn.Params().MustString("name", "")
+	revision := txn.Params().MustInt64("revision", 0)
+	table, ok := Servs.RouterTableRevision(name, revision)
+	if !ok {
+		cheshire.Flash(txn, "error", fmt.Sprintf("Cant find revision %d", revision))
+		cheshire.Redirect(txn, fmt.Sprintf("/service/history?name=%s", name))
+		return
+	}
+	bytes, err := table.ToDynMap().MarshalJSON()
+	if err != nil {
+		cheshire.Flash(txn, "error", fmt.Sprintf("%s", err))
+	}
+	context := make(map[string]interface{})
+	context["service"] = name
+	context["revision"] = revision
+	context["router_table"] = string(bytes)
+	cheshire.RenderInLayout(txn, "/revision.html", "/template.html", context)
+}
+
+func ServiceRollbackHtml(txn *cheshire.Txn) {
+	name := txn.Params().MustString("name", "")
+	revision := txn.Params().MustInt64("revision", 0)
+	rt, err := Servs.Rollback(name, revision)
+	if err != nil {
+		cheshire.Flash(txn, "error", fmt.Sprintf("%s", err))
+		cheshire.Redirect(txn, fmt.Sprintf("/service/history?name=%s", name))
+		return
+	}
+	_, ok := RouterTableUpdate(Servs, rt, len(rt.Entries))
+	if !ok {
+		cheshire.Flash(txn, "error", "Rolled back, but didnt update any router tables")
+	} else {
+		cheshire.Flash(txn, "success", fmt.Sprintf("Rolled back to revision %d as revision %d", revision, rt.Revision))
+	}
+	cheshire.Redirect(txn, fmt.Sprintf("/service?name=%s", name))
+}
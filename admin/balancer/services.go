@@ -6,35 +6,81 @@ import (
 	"fmt"
 	"github.com/trendrr/goshire-shards/shards"
 	clog "github.com/trendrr/goshire/log"
-	"io/ioutil"
+	"bufio"
+	"bytes"
+	"io"
 	"log"
+	"os"
 	"sort"
+	"strconv"
 	"sync"
 )
 
+// max number of revisions we keep in memory per service.
+// older ones are still in the history file
+const maxHistory = 50
+
 type Services struct {
 	DataDir  string
 	services map[string]*shards.RouterTable
-	Logger   *clog.Logger
-	lock     sync.Mutex
+	//transfer settings for rebalances, by service
+	transfers map[string]*TransferSettings
+	Logger    *clog.Logger
+	lock      sync.Mutex
+
+	//recent revisions by service, oldest first.  loaded from the history file on first use
+	history map[string][]*shards.RouterTable
+
+	//listeners for partition copy progress, see ListenProgress
+	progressListeners map[chan *shards.TransferProgress]bool
+	progressLock      sync.Mutex
 }
 
 var Servs = &Services{
-	services: make(map[string]*shards.RouterTable),
-	Logger:   clog.NewLogger(),
+	services:  make(map[string]*shards.RouterTable),
+	transfers: make(map[string]*TransferSettings),
+	history:   make(map[string][]*shards.RouterTable),
+	Logger:    clog.NewLogger(),
+}
+
+// How partitions are copied between entries during a rebalance
+type TransferSettings struct {
+	//see shards.COMPRESSION_GZIP
+	Compression string
+	//max bytes per second, 0 is unlimited
+	Rate int64
+}
+
+func ToTransferSettings(mp *dynmap.DynMap) (*TransferSettings, error) {
+	settings := &TransferSettings{
+		Compression: mp.MustString("compression", shards.COMPRESSION_NONE),
+		Rate:        mp.MustInt64("rate", 0),
+	}
+	if !shards.ValidCompression(settings.Compression) {
+		return nil, fmt.Errorf("Unknown compression %s", settings.Compression)
+	}
+	if settings.Rate < 0 {
+		return nil, fmt.Errorf("Rate must not be negative")
+	}
+	return settings, nil
+}
+
+func (this *TransferSettings) ToDynMap() *dynmap.DynMap {
+	mp := dynmap.NewDynMap()
+	mp.Put("compression", this.Compression)
+	mp.Put("rate", this.Rate)
+	return mp
 }
 
 func (this *Services) Load() error {
 	this.lock.Lock()
 	defer this.lock.Unlock()
-	//attempt to load from datadir
-	filename := fmt.Sprintf("%s/%s", this.DataDir, "services.json")
-	bytes, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return err
-	}
+	//attempt to load from datadir, falls back to older generations if the file is damaged
 	mp := dynmap.NewDynMap()
-	err = mp.UnmarshalJSON(bytes)
+	_, err := shards.ReadFileSafe(this.filename(), shards.DEFAULT_GENERATIONS, func(bytes []byte) error {
+		mp = dynmap.NewDynMap()
+		return mp.UnmarshalJSON(bytes)
+	})
 	if err != nil {
 		return err
 	}
@@ -49,11 +95,93 @@ func (this *Services) Load() error {
 			log.Println(err)
 			continue
 		}
+		shards.ObserveRevision(table.Revision)
 		this.services[k] = table
+		//make sure the history has the current table
+		_, ok = this.findRevision(k, table.Revision)
+		if !ok {
+			err = this.appendHistory(table)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}
+
+	err = this.loadTransfers()
+	if err != nil {
+		log.Printf("Error loading transfer settings %s", err)
 	}
 	return nil
 }
 
+// caller should hold the lock
+func (this *Services) loadTransfers() error {
+	mp := dynmap.NewDynMap()
+	_, err := shards.ReadFileSafe(this.transfersFilename(), 1, func(bytes []byte) error {
+		mp = dynmap.NewDynMap()
+		return mp.UnmarshalJSON(bytes)
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for k, _ := range mp.Map {
+		sm, ok := mp.GetDynMap(k)
+		if !ok {
+			continue
+		}
+		settings, err := ToTransferSettings(sm)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		this.transfers[k] = settings
+	}
+	return nil
+}
+
+// caller should hold the lock
+func (this *Services) saveTransfers() error {
+	mp := dynmap.NewDynMap()
+	for k, v := range this.transfers {
+		mp.Put(k, v.ToDynMap())
+	}
+	bytes, err := mp.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	return shards.WriteFileSafe(this.transfersFilename(), bytes, 1)
+}
+
+func (this *Services) transfersFilename() string {
+	return fmt.Sprintf("%s/%s", this.DataDir, "transfers.json")
+}
+
+// The transfer settings for the service, the defaults (uncompressed, unlimited) if none were set
+func (this *Services) TransferSettings(service string) *TransferSettings {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	settings, ok := this.transfers[service]
+	if !ok {
+		return &TransferSettings{}
+	}
+	c := *settings
+	return &c
+}
+
+// Sets and saves the transfer settings for the service
+func (this *Services) SetTransferSettings(service string, settings *TransferSettings) error {
+	if !shards.ValidCompression(settings.Compression) {
+		return fmt.Errorf("Unknown compression %s", settings.Compression)
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.transfers[service] = settings
+	return this.saveTransfers()
+}
+
 func (this *Services) Save() error {
 	this.lock.Lock()
 	defer this.lock.Unlock()
@@ -69,12 +197,44 @@ func (this *Services) Save() error {
 		this.Logger.Printf("Error marshalling services table -- %s", err)
 		return err
 	}
-	err = ioutil.WriteFile(fmt.Sprintf("%s/%s", this.DataDir, "services.json"), bytes, 0644)
+	err = shards.WriteFileSafe(this.filename(), bytes, shards.DEFAULT_GENERATIONS)
 	return err
 }
 
+// Registers a channel to receive the progress of partition copies.
+// updates are dropped if the channel is full.
+func (this *Services) ListenProgress(progress chan *shards.TransferProgress) {
+	this.progressLock.Lock()
+	defer this.progressLock.Unlock()
+	if this.progressListeners == nil {
+		this.progressListeners = make(map[chan *shards.TransferProgress]bool)
+	}
+	this.progressListeners[progress] = true
+}
+
+func (this *Services) UnlistenProgress(progress chan *shards.TransferProgress) {
+	this.progressLock.Lock()
+	defer this.progressLock.Unlock()
+	delete(this.progressListeners, progress)
+}
+
+func (this *Services) publishProgress(progress *shards.TransferProgress) {
+	this.progressLock.Lock()
+	defer this.progressLock.Unlock()
+	for listener, _ := range this.progressListeners {
+		select {
+		case listener <- progress:
+		default:
+		}
+	}
+}
+
+func (this *Services) filename() string {
+	return fmt.Sprintf("%s/%s", this.DataDir, "services.json")
+}
+
 //Will create and save a new router table.
-func (this *Services) NewRouterTable(service string, totalshards int, repFactor int, partitionKeys []string) error {
+func (this *Services) NewRouterTable(service string, totalshards int, repFactor int, partitionKeys []string, hashAlgorithm string) error {
 
 	_, ok := this.RouterTable(service)
 	if ok {
@@ -82,12 +242,17 @@ func (this *Services) NewRouterTable(service string, totalshards int, repFactor
 		return fmt.Errorf("Router Table %s already exists!", service)
 	}
 
+	_, err := shards.NewHasher(hashAlgorithm)
+	if err != nil {
+		return err
+	}
+
 	rt := shards.NewRouterTable(service)
 	rt.TotalPartitions = totalshards
 	rt.ReplicationFactor = repFactor
 	rt.PartitionKeys = partitionKeys
-	this.SetRouterTable(rt)
-	return nil
+	rt.HashAlgorithm = hashAlgorithm
+	return this.SetRouterTable(rt)
 }
 
 func (this *Services) Remove(service string) {
@@ -96,16 +261,262 @@ func (this *Services) Remove(service string) {
 	this.lock.Lock()
 	defer this.lock.Unlock()
 	delete(this.services, service)
+	delete(this.history, service)
+	if _, ok := this.transfers[service]; ok {
+		delete(this.transfers, service)
+		this.saveTransfers()
+	}
 }
 
-func (this *Services) SetRouterTable(table *shards.RouterTable) {
+// Sets the router table for the service, and records it in the history.
+// The table is validated first, a table with any errors is rejected.
+func (this *Services) SetRouterTable(table *shards.RouterTable) error {
+	problems := table.Validate()
+	for _, p := range problems {
+		this.Logger.Printf("Router table %s revision %d %s", table.Service, table.Revision, p)
+	}
+	err := shards.ProblemsError(problems)
+	if err != nil {
+		return err
+	}
+
 	this.lock.Lock()
+	shards.ObserveRevision(table.Revision)
+	old, hasOld := this.services[table.Service]
 	this.services[table.Service] = table
+	if !hasOld || old.Revision != table.Revision {
+		err = this.appendHistory(table)
+	}
 	this.lock.Unlock()
-	err := this.Save()
+	if err != nil {
+		log.Printf("Error saving history %s", err)
+	}
+	err = this.Save()
 	if err != nil {
 		log.Printf("Error saving %s", err)
 	}
+
+	if hasOld {
+		diff := old.Diff(table)
+		this.Logger.Printf("Router table %s revision %d -> %d", table.Service, diff.FromRevision, diff.ToRevision)
+		for _, line := range diff.Lines() {
+			this.Logger.Printf("  %s", line)
+		}
+	}
+	return nil
+}
+
+// The append only history file for a service.
+// every revision is stored, one json router table per line
+func (this *Services) historyFilename(service string) string {
+	return fmt.Sprintf("%s/%s.history", this.DataDir, service)
+}
+
+// appends the table to the history file, and the recent revisions in memory.
+// caller should hold the lock
+func (this *Services) appendHistory(table *shards.RouterTable) error {
+	tables, err := this.historyTables(table.Service)
+	if err != nil {
+		return err
+	}
+	tables = append(tables[:len(tables):len(tables)], table)
+	if len(tables) > maxHistory {
+		tables = tables[len(tables)-maxHistory:]
+	}
+	this.history[table.Service] = tables
+
+	bytes, err := table.ToDynMap().MarshalJSON()
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(this.historyFilename(table.Service), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(bytes, '\n'))
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// the last maxHistory revisions of the router table, oldest first.
+// the history file is only read the first time.
+// caller should hold the lock
+func (this *Services) historyTables(service string) ([]*shards.RouterTable, error) {
+	if this.history == nil {
+		this.history = make(map[string][]*shards.RouterTable)
+	}
+	tables, ok := this.history[service]
+	if ok {
+		return tables, nil
+	}
+	//only parse the lines we keep
+	lines := make([][]byte, 0)
+	err := this.scanHistory(service, func(line []byte) bool {
+		lines = append(lines, line)
+		if len(lines) > maxHistory {
+			lines = lines[1:]
+		}
+		return true
+	})
+	tables = make([]*shards.RouterTable, 0, len(lines))
+	for _, line := range lines {
+		table, ok := parseHistory(service, line)
+		if ok {
+			tables = append(tables, table)
+		}
+	}
+	if err != nil {
+		return tables, err
+	}
+	this.history[service] = tables
+	return tables, nil
+}
+
+// calls fn with every line of the history file, oldest first.
+// stops early if fn returns false.
+func (this *Services) scanHistory(service string, fn func(line []byte) bool) error {
+	file, err := os.Open(this.historyFilename(service))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			if !fn(line) {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parses a line of the history file.  returns false for a damaged line
+func parseHistory(service string, line []byte) (*shards.RouterTable, bool) {
+	mp := dynmap.NewDynMap()
+	err := mp.UnmarshalJSON(line)
+	if err != nil {
+		//a partial write, skip it.
+		log.Printf("Skipping bad history line for %s -- %s", service, err)
+		return nil, false
+	}
+	table, err := shards.ToRouterTable(mp)
+	if err != nil {
+		log.Printf("Skipping bad history table for %s -- %s", service, err)
+		return nil, false
+	}
+	return table, true
+}
+
+// Looks in the recent revisions first, then the history file.
+// only lines that contain the revision number are parsed.
+// caller should hold the lock
+func (this *Services) findRevision(service string, revision int64) (*shards.RouterTable, bool) {
+	tables, err := this.historyTables(service)
+	if err != nil {
+		log.Println(err)
+	}
+	for _, t := range tables {
+		if t.Revision == revision {
+			return t, true
+		}
+	}
+
+	var found *shards.RouterTable
+	rev := []byte(strconv.FormatInt(revision, 10))
+	err = this.scanHistory(service, func(line []byte) bool {
+		if !bytes.Contains(line, rev) {
+			return true
+		}
+		table, ok := parseHistory(service, line)
+		if ok && table.Revision == revision {
+			found = table
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return found, found != nil
+}
+
+// Returns the recent revisions of the router table (at most maxHistory), oldest first.
+// older revisions can still be found with RouterTableRevision
+func (this *Services) History(service string) ([]*shards.RouterTable, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	tables, err := this.historyTables(service)
+	return append([]*shards.RouterTable{}, tables...), err
+}
+
+// Finds a specific revision of the router table.
+func (this *Services) RouterTableRevision(service string, revision int64) (*shards.RouterTable, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.findRevision(service, revision)
+}
+
+// Returns the revision before the given one, if we have it.
+func (this *Services) PreviousRouterTable(service string, revision int64) (*shards.RouterTable, bool) {
+	tables, err := this.History(service)
+	if err != nil {
+		log.Println(err)
+	}
+	var prev *shards.RouterTable
+	for _, t := range tables {
+		if t.Revision >= revision {
+			break
+		}
+		prev = t
+	}
+	return prev, prev != nil
+}
+
+// Publishes an old revision of the router table as a new revision.
+// Note this only changes the router table, no data is moved.
+// returns the new router table, which should be pushed to the entries.
+func (this *Services) Rollback(service string, revision int64) (*shards.RouterTable, error) {
+	old, ok := this.RouterTableRevision(service, revision)
+	if !ok {
+		return nil, fmt.Errorf("Revision %d not found for service %s", revision, service)
+	}
+	current, ok := this.RouterTable(service)
+	if !ok {
+		return nil, fmt.Errorf("Service %s not found", service)
+	}
+
+	//copy it
+	rt, err := shards.ToRouterTable(old.ToDynMap())
+	if err != nil {
+		return nil, err
+	}
+	//must be newer then the current table
+	rt.Revision = current.Revision
+	rt.UpdateRevision()
+	rt, err = rt.Rebuild()
+	if err != nil {
+		return nil, err
+	}
+	this.Logger.Printf("Rolling back %s to revision %d as revision %d", service, revision, rt.Revision)
+	err = this.SetRouterTable(rt)
+	if err != nil {
+		return nil, err
+	}
+	return rt, nil
 }
 
 func (this *Services) RouterTable(service string) (*shards.RouterTable, bool) {
@@ -0,0 +1,66 @@
+package balancer
+
+import (
+	"github.com/trendrr/goshire-shards/shards"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	services, cleanup := testServices(t)
+	defer cleanup()
+
+	rt := shards.NewRouterTable("testdb")
+	rt.TotalPartitions = 2
+	rt.Entries = []*shards.RouterEntry{
+		&shards.RouterEntry{Address: "127.0.0.1", JsonPort: 1, HttpPort: 1, BinPort: 1, Partitions: []int{0, 1}},
+	}
+	revisions := make([]int64, 0)
+	for i := 0; i < maxHistory+10; i++ {
+		rt.UpdateRevision()
+		table, err := rt.Rebuild()
+		if err != nil {
+			t.Fatalf("Error %s", err)
+		}
+		err = services.SetRouterTable(table)
+		if err != nil {
+			t.Fatalf("Error %s", err)
+		}
+		revisions = append(revisions, table.Revision)
+	}
+
+	tables, err := services.History("testdb")
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if len(tables) != maxHistory {
+		t.Fatalf("Expected %d revisions, got %d", maxHistory, len(tables))
+	}
+	if tables[0].Revision != revisions[10] {
+		t.Errorf("Expected the oldest revision to be %d, got %d", revisions[10], tables[0].Revision)
+	}
+	//older revisions are still in the file, so they can be rolled back to
+	for _, rev := range []int64{revisions[0], revisions[9]} {
+		table, ok := services.RouterTableRevision("testdb", rev)
+		if !ok || table.Revision != rev {
+			t.Errorf("Expected to find revision %d", rev)
+		}
+	}
+
+	reloaded := &Services{DataDir: services.DataDir}
+	tables, err = reloaded.History("testdb")
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if len(tables) != maxHistory || tables[0].Revision != revisions[10] {
+		t.Errorf("Expected the last %d revisions after a reload, got %d", maxHistory, len(tables))
+	}
+	for _, rev := range []int64{revisions[0], revisions[len(revisions)-1]} {
+		table, ok := reloaded.RouterTableRevision("testdb", rev)
+		if !ok || table.Revision != rev {
+			t.Errorf("Expected to find revision %d after a reload", rev)
+		}
+	}
+	if _, ok := reloaded.RouterTableRevision("testdb", revisions[0]-1); ok {
+		t.Errorf("Expected revision %d not to be found", revisions[0]-1)
+	}
+}
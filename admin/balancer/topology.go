@@ -9,31 +9,86 @@ import (
 	// "io/ioutil"
 	"log"
 	"math/rand"
+	"os"
+	"sync/atomic"
 	"time"
 )
 
 // All the operations necessary for rebalance and topology changes
 
-// Locks the specified partition.
+// How long the admin holds partition locks for.
+// if the admin dies while holding a lock, the lock expires after this.
+var LockTTL = 10 * time.Minute
+
+// How many times CopyData tries before giving up
+var CopyAttempts = 3
+
+// How long CopyData waits before retrying
+var CopyRetryDelay = 5 * time.Second
+
+// counts the lock owners handed out, see LockOwner
+var lockOwners int64
+
+// The owner name the admin uses for partition locks.
+// Every call returns a new owner (admin@hostname/move id), so two moves of the same
+// partition, from this or another admin on the same host, never share a lock.
+func LockOwner() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	id := atomic.AddInt64(&lockOwners, 1)
+	return fmt.Sprintf("admin@%s/%d-%d", hostname, time.Now().UnixNano(), id)
+}
+
+// Locks the specified partition on every entry, with a new owner (see LockOwner).
 // Note, this does NOT update the routertable
 // it is assumed the router table is up to date.
-func LockPartition(services *Services, routerTable *shards.RouterTable, partition int) error {
-	return locking(shards.PARTITION_LOCK, services, routerTable, partition)
+// returns the fencing token from each entry, by entry id.
+// If any entry refuses the lock (someone else holds it) the locks we did get are released
+// and an error is returned.  Entries that cannot be contacted are skipped.
+func LockPartition(services *Services, routerTable *shards.RouterTable, partition int) (map[string]int64, error) {
+	tokens := make(map[string]int64)
+	owner := LockOwner()
+	services.Logger.Printf("Locking partition %d as %s", partition, owner)
+	request := cheshire.NewRequest(shards.PARTITION_LOCK, "POST")
+	request.Params().Put("partition", partition)
+	request.Params().Put("owner", owner)
+	request.Params().Put("ttl", int(LockTTL/time.Second))
+	// Lock All partitions
+	for _, e := range routerTable.Entries {
+		response, err := client.HttpApiCallSync(
+			fmt.Sprintf("%s:%d", e.Address, e.HttpPort),
+			request,
+			5*time.Second)
+		if err != nil {
+			services.Logger.Printf("ERROR While contacting %s -- %s", e.Id(), err)
+			//TODO: retry?
+			continue
+		}
+		if response.StatusCode() != 200 {
+			services.Logger.Printf("ERROR While locking partition %s -- %s", e.Id(), response.StatusMessage())
+			UnlockPartition(services, routerTable, partition, tokens)
+			return nil, fmt.Errorf("Unable to lock partition %d on %s -- %s", partition, e.Id(), response.StatusMessage())
+		}
+		tokens[e.Id()] = response.MustInt64("lock.token", int64(0))
+	}
+	return tokens, nil
 }
 
 // Unlocks the specified partition.
 // Note, this does NOT update the routertable
 // it is assumed the router table is up to date.
-func UnlockPartition(services *Services, routerTable *shards.RouterTable, partition int) error {
-	return locking(shards.PARTITION_UNLOCK, services, routerTable, partition)
-}
-
-// internal lock code shared by unlock and lock. (different endpoints)
-func locking(endpoint string, services *Services, routerTable *shards.RouterTable, partition int) error {
-	request := cheshire.NewRequest(endpoint, "POST")
-	request.Params().Put("partition", partition)
-	// Lock All partitions
+// tokens are the fencing tokens from LockPartition
+func UnlockPartition(services *Services, routerTable *shards.RouterTable, partition int, tokens map[string]int64) error {
 	for _, e := range routerTable.Entries {
+		token, ok := tokens[e.Id()]
+		if !ok {
+			continue
+		}
+		request := cheshire.NewRequest(shards.PARTITION_UNLOCK, "POST")
+		request.Params().Put("partition", partition)
+		request.Params().Put("token", token)
 		response, err := client.HttpApiCallSync(
 			fmt.Sprintf("%s:%d", e.Address, e.HttpPort),
 			request,
@@ -45,7 +100,7 @@ func locking(endpoint string, services *Services, routerTable *shards.RouterTabl
 		}
 		if response.StatusCode() != 200 {
 			//TODO: retry?
-			services.Logger.Printf("ERROR While locking partition %s -- %s", e.Id(), response.StatusMessage())
+			services.Logger.Printf("ERROR While unlocking partition %s -- %s", e.Id(), response.StatusMessage())
 		}
 	}
 	return nil
@@ -53,11 +108,16 @@ func locking(endpoint string, services *Services, routerTable *shards.RouterTabl
 
 // Delete the requested partition from the entry.
 // this does not lock, and does not update the router table
-func DeletePartition(services *Services, entry *shards.RouterEntry, partition int) error {
+// if revision is not 0, the entry will only delete if its router table is at least that
+// revision and it is no longer responsible for the partition.
+func DeletePartition(services *Services, entry *shards.RouterEntry, partition int, revision int64) error {
 
 	services.Logger.Printf("DELETING Partition %d From %s", partition, entry.Id())
 	request := cheshire.NewRequest(shards.PARTITION_DELETE, "DELETE")
 	request.Params().Put("partition", partition)
+	if revision != 0 {
+		request.Params().Put(shards.P_REVISION, revision)
+	}
 
 	response, err := client.HttpApiCallSync(
 		fmt.Sprintf("%s:%d", entry.Address, entry.HttpPort),
@@ -74,21 +134,135 @@ func DeletePartition(services *Services, entry *shards.RouterEntry, partition in
 	return nil
 }
 
+// Gets a marker for the current state of the partition from the entry.
+// returns false if the entry does not support exporting changes
+func PartitionMarker(entry *shards.RouterEntry, partition int) (string, bool, error) {
+	request := cheshire.NewRequest(shards.PARTITION_MARKER, "GET")
+	request.Params().Put("partition", partition)
+
+	response, err := client.HttpApiCallSync(
+		fmt.Sprintf("%s:%d", entry.Address, entry.HttpPort),
+		request,
+		300*time.Second)
+	if err != nil {
+		return "", true, err
+	}
+	if response.StatusCode() == shards.E_NOT_SUPPORTED {
+		return "", false, nil
+	}
+	if response.StatusCode() != 200 {
+		return "", true, fmt.Errorf("ERROR While getting marker from %s: %s", entry.Id(), response.StatusMessage())
+	}
+	marker, ok := response.GetString("marker")
+	if !ok {
+		return "", true, fmt.Errorf("No marker in response from %s", entry.Id())
+	}
+	return marker, true, nil
+}
+
+// The calls MovePartition makes to entries for checksums, deletes, unlocks
+// and router table updates.  Replaced in tests.
+var (
+	partitionChecksum = PartitionChecksum
+	deletePartition   = DeletePartition
+	unlockPartition   = UnlockPartition
+	routerTableSync   = shards.RouterTableSync
+)
+
+// Gets the checksum of the partition from the entry.
+// returns false if the entry does not support checksums
+func PartitionChecksum(entry *shards.RouterEntry, partition int) (*shards.Checksum, bool, error) {
+	request := cheshire.NewRequest(shards.PARTITION_CHECKSUM, "GET")
+	request.Params().Put("partition", partition)
+
+	response, err := client.HttpApiCallSync(
+		fmt.Sprintf("%s:%d", entry.Address, entry.HttpPort),
+		request,
+		300*time.Second)
+	if err != nil {
+		return nil, true, err
+	}
+	if response.StatusCode() == shards.E_NOT_SUPPORTED {
+		return nil, false, nil
+	}
+	if response.StatusCode() != 200 {
+		return nil, true, fmt.Errorf("ERROR While getting checksum from %s: %s", entry.Id(), response.StatusMessage())
+	}
+	mp, ok := response.GetDynMap("checksum")
+	if !ok {
+		return nil, true, fmt.Errorf("No checksum in response from %s", entry.Id())
+	}
+	checksum, err := shards.ToChecksum(mp)
+	return checksum, true, err
+}
+
+// Checks that both entries hold the same data for the partition.
+// The partition should be locked so the data does not change in between.
+// Verification is skipped (with a warning) when either entry does not support checksums.
+func VerifyPartition(services *Services, partition int, from, to *shards.RouterEntry) error {
+	fromSum, supported, err := partitionChecksum(from, partition)
+	if err != nil {
+		return err
+	}
+	if !supported {
+		services.Logger.Printf("WARNING %s does not support checksums, partition %d was not verified", from.Id(), partition)
+		return nil
+	}
+	toSum, supported, err := partitionChecksum(to, partition)
+	if err != nil {
+		return err
+	}
+	if !supported {
+		services.Logger.Printf("WARNING %s does not support checksums, partition %d was not verified", to.Id(), partition)
+		return nil
+	}
+	if !fromSum.Equals(toSum) {
+		return fmt.Errorf("Partition %d checksum mismatch: %s has %s, %s has %s", partition, from.Id(), fromSum, to.Id(), toSum)
+	}
+	services.Logger.Printf("Verified partition %d, %s", partition, toSum)
+	return nil
+}
+
 // tests that this entry is contactable, and is a proper service
-func EntryContact(entry *shards.RouterEntry) error {
+// returns the node id of the entry (empty for nodes that dont report one)
+func EntryContact(entry *shards.RouterEntry) (string, error) {
+	_, nodeId, err := entryContact(entry)
+	return nodeId, err
+}
+
+// Like EntryContact, but also fails if the entry could not find itself in its router table.
+// Only makes sense for entries that are already in the router table.
+func EntryContactMember(entry *shards.RouterEntry) error {
+	response, _, err := entryContact(entry)
+	if err != nil {
+		return err
+	}
+	identityErr := response.MustString("identity_error", "")
+	if len(identityErr) > 0 {
+		return fmt.Errorf("ERROR %s does not know its entry -- %s", entry.Address, identityErr)
+	}
+	return nil
+}
+
+// does the checkin for EntryContact, returns the checkin response and the node id
+func entryContact(entry *shards.RouterEntry) (*cheshire.Response, string, error) {
 	response, err := client.HttpApiCallSync(
 		fmt.Sprintf("%s:%d", entry.Address, entry.HttpPort),
 		cheshire.NewRequest(shards.CHECKIN, "GET"),
 		5*time.Second)
 	if err != nil {
-		return fmt.Errorf("ERROR While contacting %s -- %s", entry.Address, err)
+		return nil, "", fmt.Errorf("ERROR While contacting %s -- %s", entry.Address, err)
 	}
 	_, ok := response.GetInt64("rt_revision")
 
 	if !ok {
-		return fmt.Errorf("ERROR No rt_revision in response from %s -- Status(%s)", entry.Address, response.StatusMessage())
+		return nil, "", fmt.Errorf("ERROR No rt_revision in response from %s -- Status(%s)", entry.Address, response.StatusMessage())
 	}
-	return nil
+	nodeId := response.MustString("node_id", "")
+	if len(entry.NodeId) > 0 && len(nodeId) > 0 && entry.NodeId != nodeId {
+		return response, nodeId, fmt.Errorf("ERROR %s reports node id %s, expected %s", entry.Address, nodeId, entry.NodeId)
+	}
+	return response, nodeId, nil
 }
 
 // Checkin to an entry.  will update their router table if it is out of date.  will update our router table if out of date.
@@ -117,6 +291,11 @@ func RouterTableUpdate(services *Services, routerTable *shards.RouterTable, maxC
 			services.Logger.Printf("%s", err)
 			continue
 		}
+		if updatelocal && rt.TotalPartitions != routerTable.TotalPartitions {
+			//a split that has not finished on every entry, see ResplitEntries
+			services.Logger.Printf("Skipping router table revision %d from %s, it has %d partitions and we have %d", rt.Revision, e.Id(), rt.TotalPartitions, routerTable.TotalPartitions)
+			continue
+		}
 		if updatelocal {
 			updated = true
 			routerTable = rt
@@ -130,20 +309,64 @@ func RouterTableUpdate(services *Services, routerTable *shards.RouterTable, maxC
 
 // Copies the partition data from one server to another.
 // This does not lock the partition, that should happen
-func CopyData(services *Services, routerTable *shards.RouterTable, partition int, from, to *shards.RouterEntry) (int, error) {
-	//Move the data!
-	moved := 0
+// When the shard supports it the copy resumes from the last checkpoint of an earlier
+// copy from the same source (even one from before an admin restart), unless restart is true.
+// Failed copies are retried up to CopyAttempts times, always resuming.
+func CopyData(services *Services, routerTable *shards.RouterTable, partition int, from, to *shards.RouterEntry, restart bool) (int, error) {
+	return retryCopy(services, from, func(attempt int) (int, error) {
+		return copyData(services, routerTable.Service, partition, from, to, !restart || attempt > 1, "")
+	})
+}
+
+// Copies the changes made to the partition since the marker from one server to another.
+// see PartitionMarker
+func CopyChanges(services *Services, routerTable *shards.RouterTable, partition int, from, to *shards.RouterEntry, marker string) (int, error) {
+	return retryCopy(services, from, func(attempt int) (int, error) {
+		return copyData(services, routerTable.Service, partition, from, to, false, marker)
+	})
+}
+
+// calls copy until it succeeds, up to CopyAttempts times
+func retryCopy(services *Services, from *shards.RouterEntry, copy func(attempt int) (int, error)) (int, error) {
+	var err error
+	for attempt := 1; attempt <= CopyAttempts; attempt++ {
+		var moved int
+		moved, err = copy(attempt)
+		if err == nil {
+			return moved, nil
+		}
+		services.Logger.Printf("ERROR While Moving data from %s (attempt %d of %d) -- %s", from.Address, attempt, CopyAttempts, err)
+		if attempt < CopyAttempts {
+			time.Sleep(CopyRetryDelay)
+		}
+	}
+	return 0, err
+}
 
+// a single import request, using the transfer settings for the service.
+// if since is not empty only the changes since that marker are imported
+func copyData(services *Services, service string, partition int, from, to *shards.RouterEntry, resume bool, since string) (int, error) {
 	toClient := client.NewJson(to.Address, to.JsonPort)
 	err := toClient.Connect()
 	if err != nil {
-		return moved, err
+		return 0, err
 	}
 	defer toClient.Close()
 
 	request := cheshire.NewRequest(shards.PARTITION_IMPORT, "POST")
 	request.Params().Put("partition", partition)
 	request.Params().Put("source", fmt.Sprintf("http://%s:%d", from.Address, from.HttpPort))
+	request.Params().Put("resume", resume)
+	if len(since) > 0 {
+		request.Params().Put("since", since)
+	}
+	settings := services.TransferSettings(service)
+	if settings.Compression != shards.COMPRESSION_NONE {
+		request.Params().Put("compression", settings.Compression)
+	}
+	if settings.Rate > 0 {
+		request.Params().Put("rate", settings.Rate)
+	}
 
 	responseChan := make(chan *cheshire.Response, 10)
 	errorChan := make(chan error)
@@ -157,50 +380,146 @@ func CopyData(services *Services, routerTable *shards.RouterTable, partition int
 	for {
 		select {
 		case response := <-responseChan:
-			bytes := response.MustInt("bytes", 0)
-			services.Logger.Printf("Moving partition %d...", partition)
+			if response.StatusCode() != 200 {
+				return 0, fmt.Errorf("Import of partition %d failed: %s", partition, response.StatusMessage())
+			}
+			if checkpoint, ok := response.GetString("checkpoint"); ok {
+				services.Logger.Printf("Moving partition %d... checkpoint %s", partition, checkpoint)
+			}
+			if mp, ok := response.GetDynMap("progress"); ok {
+				progress, err := shards.ToTransferProgress(mp)
+				if err == nil {
+					progress.Service = service
+					services.Logger.Printf("Moving partition %d... %s", partition, progress)
+					services.publishProgress(progress)
+				}
+			}
 
 			//check for completion
 			if response.TxnComplete() {
 				// FINISHED!
-				services.Logger.Printf("SUCCESSFULLY Moved partition %d!", partition)
-				return bytes, nil
+				if response.MustBool("resumed", false) {
+					services.Logger.Printf("SUCCESSFULLY Moved partition %d! (resumed from checkpoint)", partition)
+				} else {
+					services.Logger.Printf("SUCCESSFULLY Moved partition %d!", partition)
+				}
+				return response.MustInt("bytes", 0), nil
 			}
 		case err := <-errorChan:
-			services.Logger.Printf("ERROR While Moving data from %s -- %s", from.Address, err)
-			return moved, err
+			return 0, err
 		}
 	}
-
-	return moved, err
 }
 
 // Moves data from one server to another
 // Does the following:
-// 1. Lock all necessary clients
-// 2. Move Data
-// 3. Update router table on servers
-// 4. Delete partion from origin
-// 5. Unlock
-func MovePartition(services *Services, routerTable *shards.RouterTable, partition int, from, to *shards.RouterEntry) error {
-
-	err := LockPartition(services, routerTable, partition)
+// 1. Record the migration in the router table, so writes go to both entries and reads to the origin
+// 2. Move Data (bulk copy, unlocked)
+// 3. Copy the changes made during the bulk copy (unlocked)
+// 4. Lock the partition, copy the changes made during step 3, verify the checksums match
+// 5. Update router table on servers (partition moved, migration removed)
+// 6. Unlock everywhere once the origin has the new table, requests queued on it are forwarded
+// 7. Delete partion from origin, fenced by the router table revision
+// If restart is true the copy ignores any checkpoint left by an earlier failed move.
+// Steps 3 and 4 only copy changes when the shard is a DeltaShard, otherwise the target relies
+// on the writes it received during the migration.
+// On a checksum mismatch the migration is aborted and the origin keeps the partition.
+// The partition is only locked for the last changes and the router table switch, not for the copy.
+func MovePartition(services *Services, routerTable *shards.RouterTable, partition int, from, to *shards.RouterEntry, restart bool) error {
+
+	routerTable, err := setMigration(services, routerTable, &shards.Migration{
+		Partition: partition,
+		From:      from.Id(),
+		To:        to.Id(),
+		Phase:     shards.MIGRATION_COPYING,
+	})
 	if err != nil {
 		return err
 	}
-	//Unlock partition no matter what
-	defer UnlockPartition(services, routerTable, partition)
+
+	//everything after the marker is sent again during the catch up
+	marker, delta, err := PartitionMarker(from, partition)
+	if err != nil {
+		abortMigration(services, routerTable, partition)
+		return err
+	}
 
 	//copy the data
-	_, err = CopyData(services, routerTable, partition, from, to)
+	_, err = CopyData(services, routerTable, partition, from, to, restart)
 
 	log.Println("Back from copy data!")
 	if err != nil {
 		log.Println(err)
+		abortMigration(services, routerTable, partition)
+		return err
+	}
+
+	routerTable, err = setMigration(services, routerTable, &shards.Migration{
+		Partition: partition,
+		From:      from.Id(),
+		To:        to.Id(),
+		Phase:     shards.MIGRATION_CATCHUP,
+	})
+	if err != nil {
+		abortMigration(services, routerTable, partition)
+		return err
+	}
+
+	if delta {
+		//catch up while unlocked, so only the changes made during this pass need the lock
+		marker, err = catchUp(services, routerTable, partition, from, to, marker)
+		if err != nil {
+			abortMigration(services, routerTable, partition)
+			return err
+		}
+	}
+
+	tokens, err := LockPartition(services, routerTable, partition)
+	if err != nil {
+		abortMigration(services, routerTable, partition)
 		return err
 	}
+	return finishMove(services, routerTable, partition, from, to, tokens, delta, marker)
+}
+
+// The locked part of MovePartition.  Copies the remaining changes (if delta), verifies the copy,
+// switches the router table, and deletes the partition from the source.
+// tokens are the locks from LockPartition, they are all released before returning.
+func finishMove(services *Services, routerTable *shards.RouterTable, partition int, from, to *shards.RouterEntry, tokens map[string]int64, delta bool, marker string) error {
+	//Unlock partition no matter what.  normally everything is unlocked right after the switch
+	defer func() {
+		unlockPartition(services, routerTable, partition, tokens)
+	}()
+	locked := time.Now()
+
+	if delta {
+		_, err := CopyChanges(services, routerTable, partition, from, to, marker)
+		if err != nil {
+			abortMigration(services, routerTable, partition)
+			return err
+		}
+	}
+
+	err := VerifyPartition(services, partition, from, to)
+	if err != nil {
+		services.Logger.Printf("ERROR verifying partition %d, not deleting it from %s -- %s", partition, from.Id(), err)
+		abortMigration(services, routerTable, partition)
+		return err
+	}
+
 	services.Logger.Printf("Now updating the router table")
 	//update the router table.
+	routerTable, err = routerTable.RemoveMigration(partition)
+	if err != nil {
+		abortMigration(services, routerTable, partition)
+		return err
+	}
+	from, okFrom := routerTable.FindEntry(from.Id())
+	to, okTo := routerTable.FindEntry(to.Id())
+	if !okFrom || !okTo {
+		abortMigration(services, routerTable, partition)
+		return fmt.Errorf("Entries for partition %d migration are no longer in the router table", partition)
+	}
 	parts := make([]int, 0)
 	for _, p := range from.Partitions {
 		if p != partition {
@@ -211,32 +530,192 @@ func MovePartition(services *Services, routerTable *shards.RouterTable, partitio
 	to.Partitions = append(to.Partitions, partition)
 
 	routerTable, err = routerTable.AddEntries(from, to)
+	if err != nil {
+		abortMigration(services, routerTable, partition)
+		return err
+	}
 
-	services.SetRouterTable(routerTable)
+	err = services.SetRouterTable(routerTable)
+	if err != nil {
+		//the data is on both entries, dont delete anything
+		abortMigration(services, routerTable, partition)
+		return err
+	}
 
 	routerTable, ok := RouterTableUpdate(services, routerTable, len(routerTable.Entries))
 	if !ok {
 		services.Logger.Printf("Uh oh, Didnt update any router tables")
 	}
 
-	//Delete the data on the from server.
-	err = DeletePartition(services, from, partition)
+	//the source must have the new table before it is unlocked, otherwise it would
+	//take requests for the partition again.  if it doesnt, it stays locked until the lease expires.
+	_, _, _, err = routerTableSync(routerTable, from)
+	if err != nil {
+		delete(tokens, from.Id())
+		return fmt.Errorf("Partition %d moved, but %s did not get the new router table so it was not deleted -- %s", partition, from.Id(), err)
+	}
+
+	//the new owner can take requests now, and requests queued on the source are forwarded to it.
+	unlockPartition(services, routerTable, partition, tokens)
+	services.Logger.Printf("Partition %d was locked for %s", partition, time.Since(locked))
+	tokens = make(map[string]int64)
+
+	//Delete the data on the from server.  fenced by the router table revision, since the lock is gone.
+	err = deletePartition(services, from, partition, routerTable.Revision)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// Moves a single partition from the largest entry to the smallest.  only
-// if the smallest entry is smaller then the rest.
-// if all entries are the same size, then a random entry is chosen
-func RebalanceSingle(services *Services, routerTable *shards.RouterTable) error {
+// Copies the changes since the marker, returns the marker to use for the next pass
+func catchUp(services *Services, routerTable *shards.RouterTable, partition int, from, to *shards.RouterEntry, marker string) (string, error) {
+	next, _, err := PartitionMarker(from, partition)
+	if err != nil {
+		return marker, err
+	}
+	moved, err := CopyChanges(services, routerTable, partition, from, to, marker)
+	if err != nil {
+		return marker, err
+	}
+	services.Logger.Printf("Partition %d caught up %d bytes of changes", partition, moved)
+	return next, nil
+}
+
+// Records the migration in the router table and pushes it to the entries.
+func setMigration(services *Services, routerTable *shards.RouterTable, migration *shards.Migration) (*shards.RouterTable, error) {
+	services.Logger.Printf("Partition %d migration from %s to %s is %s", migration.Partition, migration.From, migration.To, migration.Phase)
+	routerTable, err := routerTable.SetMigration(migration)
+	if err != nil {
+		return routerTable, err
+	}
+	err = services.SetRouterTable(routerTable)
+	if err != nil {
+		return routerTable, err
+	}
+	routerTable, ok := RouterTableUpdate(services, routerTable, len(routerTable.Entries))
+	if !ok {
+		services.Logger.Printf("Uh oh, Didnt update any router tables")
+	}
+	return routerTable, nil
+}
+
+// Removes a failed migration from the router table.  The origin still
+// has all the data, so nothing is deleted.
+func abortMigration(services *Services, routerTable *shards.RouterTable, partition int) {
+	services.Logger.Printf("Aborting migration of partition %d", partition)
+	current, ok := services.RouterTable(routerTable.Service)
+	if ok {
+		routerTable = current
+	}
+	if _, ok := routerTable.Migration(partition); !ok {
+		return
+	}
+	routerTable, err := routerTable.RemoveMigration(partition)
+	if err != nil {
+		services.Logger.Printf("ERROR removing migration of partition %d -- %s", partition, err)
+		return
+	}
+	err = services.SetRouterTable(routerTable)
+	if err != nil {
+		services.Logger.Printf("ERROR removing migration of partition %d -- %s", partition, err)
+		return
+	}
+	RouterTableUpdate(services, routerTable, len(routerTable.Entries))
+}
+
+// Multiplies the number of partitions by factor.
+// Every entry splits its partitions and switches to the new table (see shards.PARTITION_SPLIT).
+// No data moves between entries.
+// If an entry fails the remaining entries are still attempted, but the split table is
+// not published (or returned) until every entry has split, see ResplitEntries.
+// Entries reject requests routed with a table from before the split, so proxies
+// still on the old table can not misfile keys in the meantime.
+func SplitPartitions(services *Services, routerTable *shards.RouterTable, factor int) (*shards.RouterTable, error) {
+	split, err := routerTable.Split(factor)
+	if err != nil {
+		return routerTable, err
+	}
+	services.Logger.Printf("Splitting %d partitions into %d", routerTable.TotalPartitions, split.TotalPartitions)
+
+	failed := splitEntries(services, split, routerTable.Entries)
+	if failed > 0 {
+		return routerTable, fmt.Errorf("%d entries failed to split, the split table was not published.  Retry to split them", failed)
+	}
+	return split, services.SetRouterTable(split)
+}
+
+// Finishes a split that failed on some entries.
+// routerTable is the (unsplit) table we have, the split table is taken from
+// the entries that did split.  The split table is published once every entry has split.
+func ResplitEntries(services *Services, routerTable *shards.RouterTable) (*shards.RouterTable, error) {
+	var split *shards.RouterTable
+	entries := make([]*shards.RouterEntry, 0)
+	for _, e := range routerTable.Entries {
+		current, err := shards.RequestRouterTableEntry(e)
+		if err != nil {
+			return routerTable, fmt.Errorf("ERROR getting router table from %s -- %s", e.Id(), err)
+		}
+		if current.TotalPartitions > routerTable.TotalPartitions {
+			if split == nil || current.Revision > split.Revision {
+				split = current
+			}
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if split == nil {
+		return routerTable, fmt.Errorf("No entry has split its partitions, start a new split")
+	}
+	if len(entries) > 0 {
+		services.Logger.Printf("Splitting %d entries that still have the old partitions", len(entries))
+		failed := splitEntries(services, split, entries)
+		if failed > 0 {
+			return routerTable, fmt.Errorf("%d entries failed to split, the split table was not published", failed)
+		}
+	}
+	services.Logger.Printf("All entries have %d partitions", split.TotalPartitions)
+	return split, services.SetRouterTable(split)
+}
+
+// sends the split request to the entries, returns the number that failed
+func splitEntries(services *Services, split *shards.RouterTable, entries []*shards.RouterEntry) int {
+	request := cheshire.NewRequest(shards.PARTITION_SPLIT, "POST")
+	request.Params().Put("router_table", split.ToDynMap())
+
+	failed := 0
+	for _, e := range entries {
+		response, err := client.HttpApiCallSync(
+			fmt.Sprintf("%s:%d", e.Address, e.HttpPort),
+			request,
+			300*time.Second)
+		if err != nil {
+			services.Logger.Printf("ERROR While splitting partitions on %s -- %s", e.Id(), err)
+			failed++
+			continue
+		}
+		if response.StatusCode() != 200 {
+			services.Logger.Printf("ERROR While splitting partitions on %s -- %s", e.Id(), response.StatusMessage())
+			failed++
+			continue
+		}
+		services.Logger.Printf("Split partitions on %s", e.Id())
+	}
+	return failed
+}
+
+// Moves a single partition from the entry that is most over its target to the
+// entry that is most under its target.  Targets are proportional to the entry weight
+// (see RouterTable.TargetPartitions).  Ties are broken randomly.
+// restart ignores the checkpoints of earlier failed copies, see MovePartition
+func RebalanceSingle(services *Services, routerTable *shards.RouterTable, restart bool) error {
 
 	var smallest *shards.RouterEntry = nil
 	var largest *shards.RouterEntry = nil
+	smallestDiff := 0
+	largestDiff := 0
 
-	min := int(routerTable.TotalPartitions / len(routerTable.Entries))
-	services.Logger.Printf("Looking for entries with more then %d partitions", min)
+	targets := routerTable.TargetPartitions()
 
 	//shuffle the entries array
 	entries := make([]*shards.RouterEntry, len(routerTable.Entries))
@@ -245,20 +724,16 @@ func RebalanceSingle(services *Services, routerTable *shards.RouterTable) error
 		entries[v] = routerTable.Entries[i]
 	}
 	for _, entry := range entries {
-		services.Logger.Printf("Entry %s has %d partitions", entry.Id(), len(entry.Partitions))
-
-		if len(entry.Partitions) < min {
-			if smallest == nil {
-				smallest = entry
-			} else if len(entry.Partitions) < len(smallest.Partitions) {
-				smallest = entry
-			}
-		} else if len(entry.Partitions) > min {
-			if largest == nil {
-				largest = entry
-			} else if len(entry.Partitions) > len(largest.Partitions) {
-				largest = entry
-			}
+		target := targets[entry.Id()]
+		services.Logger.Printf("Entry %s has %d partitions (target %d, weight %d)", entry.Id(), len(entry.Partitions), target, entry.Weight)
+
+		diff := len(entry.Partitions) - target
+		if diff < smallestDiff {
+			smallest = entry
+			smallestDiff = diff
+		} else if diff > largestDiff {
+			largest = entry
+			largestDiff = diff
 		}
 
 	}
@@ -268,7 +743,7 @@ func RebalanceSingle(services *Services, routerTable *shards.RouterTable) error
 	}
 	partition := largest.Partitions[0]
 	services.Logger.Printf("Moving partition %d from %s to %s", partition, largest.Id(), smallest.Id())
-	err := MovePartition(services, routerTable, partition, largest, smallest)
+	err := MovePartition(services, routerTable, partition, largest, smallest, restart)
 	if err != nil {
 		services.Logger.Printf("ERROR During move %s", err)
 	}
@@ -0,0 +1,278 @@
+package balancer
+
+import (
+	"fmt"
+	"github.com/trendrr/goshire-shards/shards"
+	clog "github.com/trendrr/goshire/log"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// replaces the checksum, delete, unlock and router table sync calls for the length of a test.
+// checksums are by entry id, entries that are missing do not support checksums
+func stubEntries(checksums map[string]*shards.Checksum, deleted *[]string) func() {
+	oldChecksum, oldDelete, oldUnlock, oldSync := partitionChecksum, deletePartition, unlockPartition, routerTableSync
+	partitionChecksum = func(entry *shards.RouterEntry, partition int) (*shards.Checksum, bool, error) {
+		c, ok := checksums[entry.Id()]
+		return c, ok, nil
+	}
+	deletePartition = func(services *Services, entry *shards.RouterEntry, partition int, revision int64) error {
+		*deleted = append(*deleted, entry.Id())
+		return nil
+	}
+	unlockPartition = func(services *Services, routerTable *shards.RouterTable, partition int, tokens map[string]int64) error {
+		return nil
+	}
+	routerTableSync = func(routerTable *shards.RouterTable, entry *shards.RouterEntry) (*shards.RouterTable, bool, bool, error) {
+		return routerTable, false, true, nil
+	}
+	return func() {
+		partitionChecksum, deletePartition, unlockPartition, routerTableSync = oldChecksum, oldDelete, oldUnlock, oldSync
+	}
+}
+
+func testServices(t *testing.T) (*Services, func()) {
+	dir, err := ioutil.TempDir("", "balancer-test")
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	services := &Services{
+		DataDir:   dir,
+		services:  make(map[string]*shards.RouterTable),
+		transfers: make(map[string]*TransferSettings),
+		Logger:    clog.NewLogger(),
+	}
+	return services, func() { os.RemoveAll(dir) }
+}
+
+// a table with partition 0 migrating from the first entry to the second.
+// the entries are not listening, so every other call to them fails.
+func migratingTable(t *testing.T, services *Services) *shards.RouterTable {
+	rt := shards.NewRouterTable("testdb")
+	rt.Revision = shards.NextRevision(0)
+	rt.TotalPartitions = 2
+	rt.Entries = []*shards.RouterEntry{
+		&shards.RouterEntry{Address: "127.0.0.1", JsonPort: 1, HttpPort: 1, BinPort: 1, Partitions: []int{0}},
+		&shards.RouterEntry{Address: "127.0.0.1", JsonPort: 2, HttpPort: 2, BinPort: 2, Partitions: []int{1}},
+	}
+	rt, err := rt.Rebuild()
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	rt, err = rt.SetMigration(&shards.Migration{
+		Partition: 0,
+		From:      rt.Entries[0].Id(),
+		To:        rt.Entries[1].Id(),
+		Phase:     shards.MIGRATION_CATCHUP,
+	})
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	err = services.SetRouterTable(rt)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	return rt
+}
+
+func TestVerifyPartition(t *testing.T) {
+	services, cleanup := testServices(t)
+	defer cleanup()
+	rt := migratingTable(t, services)
+	from, to := rt.Entries[0], rt.Entries[1]
+	sum := &shards.Checksum{Count: 10, Digest: "9e107d9d372bb6826bd81d3542a419d6"}
+
+	tests := []struct {
+		name      string
+		checksums map[string]*shards.Checksum
+		ok        bool
+	}{
+		{"match", map[string]*shards.Checksum{from.Id(): sum, to.Id(): sum}, true},
+		{"mismatch", map[string]*shards.Checksum{from.Id(): sum, to.Id(): &shards.Checksum{Count: 9, Digest: sum.Digest}}, false},
+		{"source unsupported", map[string]*shards.Checksum{to.Id(): sum}, true},
+		{"target unsupported", map[string]*shards.Checksum{from.Id(): sum}, true},
+	}
+	for _, test := range tests {
+		var deleted []string
+		restore := stubEntries(test.checksums, &deleted)
+		err := VerifyPartition(services, 0, from, to)
+		restore()
+		if test.ok && err != nil {
+			t.Errorf("%s: expected no error, got %s", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+
+	restore := stubEntries(nil, nil)
+	partitionChecksum = func(entry *shards.RouterEntry, partition int) (*shards.Checksum, bool, error) {
+		return nil, true, fmt.Errorf("unreachable")
+	}
+	err := VerifyPartition(services, 0, from, to)
+	restore()
+	if err == nil {
+		t.Errorf("Expected an error when the checksum cannot be fetched")
+	}
+}
+
+func TestFinishMoveMismatch(t *testing.T) {
+	services, cleanup := testServices(t)
+	defer cleanup()
+	rt := migratingTable(t, services)
+	from, to := rt.Entries[0], rt.Entries[1]
+
+	var deleted []string
+	restore := stubEntries(map[string]*shards.Checksum{
+		from.Id(): &shards.Checksum{Count: 10, Digest: "9e107d9d372bb6826bd81d3542a419d6"},
+		to.Id():   &shards.Checksum{Count: 7, Digest: "e4d909c290d0fb1ca068ffaddf22cbd0"},
+	}, &deleted)
+	defer restore()
+
+	tokens := map[string]int64{from.Id(): 1, to.Id(): 2}
+	err := finishMove(services, rt, 0, from, to, tokens, false, "")
+	if err == nil {
+		t.Fatalf("Expected the move to fail on a checksum mismatch")
+	}
+	if len(deleted) > 0 {
+		t.Errorf("Expected nothing to be deleted, deleted partition from %v", deleted)
+	}
+
+	current, _ := services.RouterTable("testdb")
+	if _, ok := current.Migration(0); ok {
+		t.Errorf("Expected the migration to be aborted")
+	}
+	entry, _ := current.FindEntry(from.Id())
+	if len(entry.Partitions) != 1 || entry.Partitions[0] != 0 {
+		t.Errorf("Expected partition 0 to stay on %s, has %v", from.Id(), entry.Partitions)
+	}
+}
+
+func TestFinishMove(t *testing.T) {
+	services, cleanup := testServices(t)
+	defer cleanup()
+	rt := migratingTable(t, services)
+	from, to := rt.Entries[0], rt.Entries[1]
+
+	var deleted []string
+	sum := &shards.Checksum{Count: 10, Digest: "9e107d9d372bb6826bd81d3542a419d6"}
+	restore := stubEntries(map[string]*shards.Checksum{from.Id(): sum, to.Id(): sum}, &deleted)
+	defer restore()
+
+	//the source is unlocked before the delete, so its queued requests are forwarded right away
+	unlocked := make(map[string]bool)
+	unlockPartition = func(services *Services, routerTable *shards.RouterTable, partition int, tokens map[string]int64) error {
+		for id, _ := range tokens {
+			unlocked[id] = true
+		}
+		return nil
+	}
+	var deleteRevision int64
+	deletePartition = func(services *Services, entry *shards.RouterEntry, partition int, revision int64) error {
+		if !unlocked[from.Id()] || !unlocked[to.Id()] {
+			t.Errorf("Expected every entry to be unlocked before the delete, unlocked %v", unlocked)
+		}
+		deleteRevision = revision
+		deleted = append(deleted, entry.Id())
+		return nil
+	}
+
+	tokens := map[string]int64{from.Id(): 1, to.Id(): 2}
+	err := finishMove(services, rt, 0, from, to, tokens, false, "")
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if len(deleted) != 1 || deleted[0] != from.Id() {
+		t.Errorf("Expected partition to be deleted from %s, deleted from %v", from.Id(), deleted)
+	}
+	current, _ := services.RouterTable("testdb")
+	entry, _ := current.FindEntry(to.Id())
+	if len(entry.Partitions) != 2 {
+		t.Errorf("Expected partition 0 to move to %s, has %v", to.Id(), entry.Partitions)
+	}
+	if deleteRevision != current.Revision {
+		t.Errorf("Expected the delete to be fenced by revision %d, got %d", current.Revision, deleteRevision)
+	}
+}
+
+// the source did not get the new table, so it keeps its lock and the data
+func TestFinishMoveSourceNotUpdated(t *testing.T) {
+	services, cleanup := testServices(t)
+	defer cleanup()
+	rt := migratingTable(t, services)
+	from, to := rt.Entries[0], rt.Entries[1]
+
+	var deleted []string
+	sum := &shards.Checksum{Count: 10, Digest: "9e107d9d372bb6826bd81d3542a419d6"}
+	restore := stubEntries(map[string]*shards.Checksum{from.Id(): sum, to.Id(): sum}, &deleted)
+	defer restore()
+	routerTableSync = func(routerTable *shards.RouterTable, entry *shards.RouterEntry) (*shards.RouterTable, bool, bool, error) {
+		return routerTable, false, false, fmt.Errorf("unreachable")
+	}
+	unlocked := make(map[string]bool)
+	unlockPartition = func(services *Services, routerTable *shards.RouterTable, partition int, tokens map[string]int64) error {
+		for id, _ := range tokens {
+			unlocked[id] = true
+		}
+		return nil
+	}
+
+	tokens := map[string]int64{from.Id(): 1, to.Id(): 2}
+	err := finishMove(services, rt, 0, from, to, tokens, false, "")
+	if err == nil {
+		t.Fatalf("Expected an error when the source does not get the new table")
+	}
+	if len(deleted) != 0 {
+		t.Errorf("Expected nothing to be deleted, deleted from %v", deleted)
+	}
+	if unlocked[from.Id()] || !unlocked[to.Id()] {
+		t.Errorf("Expected only the target to be unlocked, unlocked %v", unlocked)
+	}
+}
+
+// the entries are not listening, so the split fails and must not be published
+func TestSplitPartitionsFailed(t *testing.T) {
+	services, cleanup := testServices(t)
+	defer cleanup()
+
+	rt := shards.NewRouterTable("testdb")
+	rt.Revision = shards.NextRevision(0)
+	rt.TotalPartitions = 2
+	rt.Entries = []*shards.RouterEntry{
+		&shards.RouterEntry{Address: "127.0.0.1", JsonPort: 1, HttpPort: 1, BinPort: 1, Partitions: []int{0}},
+		&shards.RouterEntry{Address: "127.0.0.1", JsonPort: 2, HttpPort: 2, BinPort: 2, Partitions: []int{1}},
+	}
+	rt, err := rt.Rebuild()
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	err = services.SetRouterTable(rt)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+
+	returned, err := SplitPartitions(services, rt, 2)
+	if err == nil {
+		t.Fatalf("Expected an error when the entries fail to split")
+	}
+	if returned.TotalPartitions != 2 {
+		t.Errorf("Returned a table with %d partitions", returned.TotalPartitions)
+	}
+	current, _ := services.RouterTable("testdb")
+	if current.Revision != rt.Revision || current.TotalPartitions != 2 {
+		t.Errorf("The split table was published, revision %d with %d partitions", current.Revision, current.TotalPartitions)
+	}
+}
+
+func TestLockOwnerUnique(t *testing.T) {
+	hostname, _ := os.Hostname()
+	a, b := LockOwner(), LockOwner()
+	if a == b {
+		t.Errorf("Expected a new lock owner for every move, got %s twice", a)
+	}
+	if hostname != "" && !strings.HasPrefix(a, "admin@"+hostname+"/") {
+		t.Errorf("Expected the owner to name the host, got %s", a)
+	}
+}
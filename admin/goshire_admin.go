@@ -7,6 +7,7 @@ import (
 	"flag"
 	"github.com/trendrr/goshire-shards/admin/balancer"
 	"github.com/trendrr/goshire/cheshire/impl/gocache"
+	"os"
 	// "time"
 	// "fmt"
 )
@@ -26,7 +27,12 @@ func main() {
 	bootstrap.AddFilters(cheshire.NewSession(cache, 3600))
 
 	balancer.Servs.DataDir = *dataDir
-	balancer.Servs.Load()
+	err := balancer.Servs.Load()
+	if os.IsNotExist(err) {
+		log.Printf("No services found in %s, starting empty", *dataDir)
+	} else if err != nil {
+		log.Printf("ERROR Unable to load services from %s (%s)", *dataDir, err)
+	}
 
 	// testrt := shards.NewRouterTable("Test")
 	// balancer.Servs.SetRouterTable(testrt)
@@ -3,6 +3,7 @@ package proxy
 // the binary protocol proxy implementation
 
 import(
+    "bytes"
     "encoding/binary"
     "io"
     "fmt"
@@ -171,57 +172,51 @@ func (this *BinProxy) Listen(proxy *Proxy) {
             break
         }
 
+        //buffer the header so we can pull the shard key from the params
+        // if needed.
+        header, err := this.readHeader(proxy.clientConn)
+        if err != nil {
+            log.Print(err)
+            break
+        }
+
         //get the partition
-        partition, err := proxy.Partition(*shardReq)
+        partition, err := proxy.Partition(*shardReq, header.paramEncoding, header.params)
         if err != nil {
             log.Print(err)
             break
         }
         shardReq.Partition = partition
+        //lets the entry reject the request if our table is from before a split
+        shardReq.Revision = proxy.service.RouterTable().Revision
         // log.Printf("Partition %d", partition)
         //find the connection
-        con, err := proxy.Conn(partition)
+        con, err := proxy.Conn(partition, header.method)
         if err != nil {
             log.Print(err)
             break
         }
 
-        cheshire.BIN.WriteShardRequest(shardReq, con.Connection)
-        //now write and copy bytes.
-        
-        txnId, err := cheshire.ReadString(proxy.clientConn)
-        cheshire.WriteString(con.Connection, txnId)
-
-        //txn id 
-        // method
-        err = cheshire.CopyN(con.Connection, proxy.clientConn, 2)
-        if err != nil {
-            log.Print(err)
-            break 
-        }
-
-        //uri
-        err = cheshire.CopyByteArray(con.Connection, proxy.clientConn)
-        if err != nil {
-            log.Print(err)
-            break 
+        mirrors := proxy.Mirrors(partition)
+        if len(mirrors) > 0 && header.method != "GET" {
+            //buffer the write so it can go to every entry accepting writes (replicas, migration target).
+            //the target does not serve reads until the migration is done.
+            err = this.writeMirrored(shardReq, header.raw, proxy.clientConn, con, mirrors)
+            if err != nil {
+                log.Print(err)
+                break
+            }
+            continue
         }
 
-        //param encoding
-        err = cheshire.CopyN(con.Connection, proxy.clientConn, 1)
-        if err != nil {
-            log.Print(err)
-            break 
-        }
-
-        //params array
-        err = cheshire.CopyByteArray(con.Connection, proxy.clientConn)
+        cheshire.BIN.WriteShardRequest(shardReq, con.Connection)
+        //now write and copy bytes.
+        _, err = header.raw.WriteTo(con.Connection)
         if err != nil {
             log.Print(err)
             break 
         }
 
-
         //content encoding
         err = cheshire.CopyN(con.Connection, proxy.clientConn, 1)
         if err != nil {
@@ -248,6 +243,109 @@ func (this *BinProxy) Listen(proxy *Proxy) {
     return 
 }
 
+// A request header, see readHeader
+type binHeader struct {
+    //the raw bytes to pass upstream
+    raw *bytes.Buffer
+    //the request method, ie GET
+    method string
+    //the param encoding, ie json
+    paramEncoding string
+    //the params array (still length prefixed)
+    params []byte
+}
+
+// Reads the txn id, method, uri, param encoding, and params from the client.
+func (this *BinProxy) readHeader(reader io.Reader) (*binHeader, error) {
+    header := &binHeader{raw : &bytes.Buffer{}}
+    txnId, err := cheshire.ReadString(reader)
+    if err != nil {
+        return nil, err
+    }
+    cheshire.WriteString(header.raw, txnId)
+
+    //txn accept and method
+    start := header.raw.Len()
+    err = cheshire.CopyN(header.raw, reader, 2)
+    if err != nil {
+        return nil, err
+    }
+    header.method = binCode(cheshire.BINCONST.Method, int8(header.raw.Bytes()[start+1]))
+
+    //uri
+    err = cheshire.CopyByteArray(header.raw, reader)
+    if err != nil {
+        return nil, err
+    }
+
+    //param encoding
+    start = header.raw.Len()
+    err = cheshire.CopyN(header.raw, reader, 1)
+    if err != nil {
+        return nil, err
+    }
+    header.paramEncoding = binCode(cheshire.BINCONST.ParamEncoding, int8(header.raw.Bytes()[start]))
+
+    //params array
+    start = header.raw.Len()
+    err = cheshire.CopyByteArray(header.raw, reader)
+    if err != nil {
+        return nil, err
+    }
+    header.params = header.raw.Bytes()[start:]
+    return header, nil
+}
+
+// finds the name for a bin protocol code, ie the method for a method code
+func binCode(codes map[string]int8, code int8) string {
+    for name, c := range codes {
+        if c == code {
+            return name
+        }
+    }
+    return ""
+}
+
+// Writes the request to the connection and a copy to each mirror.
+// The content is buffered, since it is needed more then once.
+func (this *BinProxy) writeMirrored(shardReq *cheshire.ShardRequest, header *bytes.Buffer, reader io.Reader, con *Conn, mirrors []*Conn) error {
+    txnId, err := cheshire.ReadString(bytes.NewReader(header.Bytes()))
+    if err != nil {
+        return err
+    }
+
+    content := &bytes.Buffer{}
+    //content encoding
+    err = cheshire.CopyN(content, reader, 1)
+    if err != nil {
+        return err
+    }
+    //content array
+    err = cheshire.CopyByteArray32(content, reader)
+    if err != nil {
+        return err
+    }
+
+    for _, m := range mirrors {
+        m.Mirror(txnId)
+    }
+    for _, c := range append([]*Conn{con}, mirrors...) {
+        cheshire.BIN.WriteShardRequest(shardReq, c.Connection)
+        _, err = c.Connection.Write(header.Bytes())
+        if err != nil {
+            return err
+        }
+        _, err = c.Connection.Write(content.Bytes())
+        if err != nil {
+            return err
+        }
+        if fl, ok := c.Connection.(cheshire.Flusher); ok {
+           fl.Flush()
+        }
+    }
+    return nil
+}
+
     //Create a new connection based on the router entry.
 func (this *BinProxy) NewConn(proxy *Proxy, entry *shards.RouterEntry) (*Conn, error) {
     //connect.
@@ -8,6 +8,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"strings"
 	"time"
 )
 
@@ -18,8 +19,14 @@ import (
 // Handles a set of connections to all the shards in the cluster
 //
 type ShardConns struct {
-	//Shard Connections indexed by Partition
-	Partitions []*ShardConn
+	//Shard Connections reads are sent to, indexed by Partition
+	Readers []*ShardConn
+	//Shard Connections writes are sent to, indexed by Partition
+	Writers []*ShardConn
+	//Connections to the other entries accepting writes (replicas and the target
+	//of an in flight migration), indexed by partition.
+	//writes are copied to these, and their responses dropped. see shards.RouterTable.WriteEntries
+	mirrors [][]*ShardConn
 	//set of the available unique connections
 	Conns []*ShardConn
 
@@ -84,7 +91,9 @@ func NewShardConns(service *Service, protocol cheshire.Protocol) (*ShardConns, e
 
 	log.Println("NEW SHARD CONNS")
 	sc := &ShardConns{
-		Partitions:   make([]*ShardConn, rt.TotalPartitions),
+		Readers:      make([]*ShardConn, rt.TotalPartitions),
+		Writers:      make([]*ShardConn, rt.TotalPartitions),
+		mirrors:      make([][]*ShardConn, rt.TotalPartitions),
 		Conns:        make([]*ShardConn, 0),
 		KillChan:     make(chan bool, 5),
 		responseChan: make(chan *cheshire.Response),
@@ -92,7 +101,13 @@ func NewShardConns(service *Service, protocol cheshire.Protocol) (*ShardConns, e
 		service:      service,
 		protocol:     protocol,
 	}
+	//connections by entry id
+	conns := make(map[string]*ShardConn)
 	for _, e := range rt.Entries {
+		if e.EntryState() == shards.ENTRY_DOWN {
+			//nothing is routed to down entries
+			continue
+		}
 		con, err := NewShardConn(e, sc)
 		if err != nil {
 			log.Println(err)
@@ -100,15 +115,87 @@ func NewShardConns(service *Service, protocol cheshire.Protocol) (*ShardConns, e
 			continue
 		}
 		sc.Conns = append(sc.Conns, con)
-
-		for _, p := range e.Partitions {
-			sc.Partitions[p] = con
-		}
+		conns[e.Id()] = con
 	}
+
+	sc.route(rt, conns)
 	go sc.proxy()
 	return sc, nil
 }
 
+// Assigns the connections (by entry id) to the partitions, see routePartition
+func (this *ShardConns) route(rt *shards.RouterTable, conns map[string]*ShardConn) {
+	for p := 0; p < rt.TotalPartitions; p++ {
+		r := routePartition(rt, p)
+		if r.read != nil {
+			this.Readers[p] = conns[r.read.Id()]
+		}
+		if r.write != nil {
+			this.Writers[p] = conns[r.write.Id()]
+		}
+		for _, e := range r.mirrors {
+			con, ok := conns[e.Id()]
+			if !ok {
+				log.Printf("No connection to %s, writes to partition %d will not be copied to it", e.Id(), p)
+				continue
+			}
+			this.mirrors[p] = append(this.mirrors[p], con)
+		}
+	}
+}
+
+// Returns the connections writes for this partition should
+// be copied to, empty if the partition has no other entry accepting writes.
+func (this *ShardConns) Mirrors(partition int) []*ShardConn {
+	if partition >= len(this.mirrors) || partition < 0 {
+		return nil
+	}
+	return this.mirrors[partition]
+}
+
+// Sends the request upstream.  Writes are copied to the rest of the entries
+// accepting writes (see routePartition), reads only go to one entry.
+func (this *ShardConns) send(req *cheshire.Request) error {
+	con, err := this.Conn(req.Shard.Partition, req.Method())
+	if err != nil {
+		return err
+	}
+	//set the revision
+	req.Shard.Revision = this.service.RouterTable().Revision
+
+	_, err = this.protocol.WriteRequest(req, con.Writer)
+	if err != nil {
+		return err
+	}
+
+	if strings.ToUpper(req.Method()) == "GET" {
+		return nil
+	}
+	for _, m := range this.Mirrors(req.Shard.Partition) {
+		m.Mirror(req.TxnId())
+		_, err = this.protocol.WriteRequest(req, m.Writer)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the connection for the partition and request method (GET requests are reads)
+func (this *ShardConns) Conn(partition int, method string) (*ShardConn, error) {
+	if partition >= len(this.Readers) || partition < 0 {
+		return nil, fmt.Errorf("Partition %d out of range", partition)
+	}
+	con := this.Writers[partition]
+	if strings.ToUpper(method) == "GET" {
+		con = this.Readers[partition]
+	}
+	if con == nil {
+		return nil, fmt.Errorf("No connection available at partition %d for %s requests", partition, method)
+	}
+	return con, nil
+}
+
 // looks through all the connections and tries to obtain an updated routertable.
 func (this *ShardConns) routerTableRequest() {
 	for _, conn := range this.Conns {
@@ -160,7 +247,13 @@ func (this *ShardConns) proxy() {
 			// more annoying.
 
 			if req.Shard.Partition < 0 {
-				partition, err := this.service.Partition(req.Shard.Key)
+				var partition int
+				var err error
+				if len(req.Shard.Key) > 0 {
+					partition, err = this.service.Partition(req.Shard.Key)
+				} else {
+					partition, err = this.service.PartitionParams(req.Params())
+				}
 				if err != nil {
 					log.Print(err)
 					//TODO: send error
@@ -170,17 +263,7 @@ func (this *ShardConns) proxy() {
 				// log.Println(partition)
 				//ready to send upstream
 			}
-			con := this.Partitions[req.Shard.Partition]
-			//set the revision
-			req.Shard.Revision = this.service.RouterTable().Revision
-
-			if con == nil {
-				log.Print("Error no connection for partition %d", req.Shard.Partition)
-				//TODO: send error
-				break
-			}
-
-			_, err := this.protocol.WriteRequest(req, con.Writer)
+			err := this.send(req)
 			if err != nil {
 				log.Print(err)
 				break
@@ -209,6 +292,9 @@ type ShardConn struct {
 	Entry    *shards.RouterEntry
 	parent   *ShardConns
 	response *cheshire.Response
+
+	//txn ids of requests copied to this connection (see ShardConns.Mirrors)
+	mirrorTxns
 }
 
 func NewShardConn(entry *shards.RouterEntry, parent *ShardConns) (*ShardConn, error) {
@@ -254,6 +340,12 @@ func (this *ShardConn) listen() {
 			log.Print(err)
 			break
 		}
+		if this.isMirrored(res) {
+			if res.StatusCode() != 200 {
+				log.Printf("Error from write copy on %s -- %d", this.Entry.Id(), res.StatusCode())
+			}
+			continue
+		}
 		this.parent.responseChan <- res
 	}
 }
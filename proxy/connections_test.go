@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"bytes"
+	"github.com/trendrr/goshire-shards/shards"
+	"github.com/trendrr/goshire/cheshire"
+	"io"
+	"testing"
+)
+
+// records the connections requests are written to
+type recordingProtocol struct {
+	cheshire.Protocol
+	writes map[io.Writer]int
+}
+
+func (this *recordingProtocol) WriteRequest(req *cheshire.Request, writer io.Writer) (int, error) {
+	this.writes[writer]++
+	return 0, nil
+}
+
+// shard conns with an unconnected ShardConn for every entry, by entry id
+func testShardConns(t *testing.T, rt *shards.RouterTable) (*ShardConns, *recordingProtocol, map[string]*ShardConn) {
+	service, err := NewService(rt)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	protocol := &recordingProtocol{Protocol: cheshire.JSON, writes: make(map[io.Writer]int)}
+	sc := &ShardConns{
+		Readers:  make([]*ShardConn, rt.TotalPartitions),
+		Writers:  make([]*ShardConn, rt.TotalPartitions),
+		mirrors:  make([][]*ShardConn, rt.TotalPartitions),
+		service:  service,
+		protocol: protocol,
+	}
+	conns := make(map[string]*ShardConn)
+	for _, e := range rt.Entries {
+		conns[e.Id()] = &ShardConn{Writer: &bytes.Buffer{}, Entry: e, parent: sc}
+	}
+	sc.route(rt, conns)
+	return sc, protocol, conns
+}
+
+func TestShardConnsReplicaWrites(t *testing.T) {
+	rt := testTable(t)
+	sc, protocol, conns := testShardConns(t, rt)
+	master, replica := conns[rt.Entries[0].Id()], conns[rt.Entries[1].Id()]
+
+	req := cheshire.NewRequest("/test", "PUT")
+	req.Shard = &cheshire.ShardRequest{Partition: 0}
+	err := sc.send(req)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if protocol.writes[master.Writer] != 1 || protocol.writes[replica.Writer] != 1 {
+		t.Errorf("Expected the write on the master and replica, master %d, replica %d", protocol.writes[master.Writer], protocol.writes[replica.Writer])
+	}
+	response := cheshire.NewResponse(&cheshire.Txn{Request: req})
+	if !replica.isMirrored(response) || master.isMirrored(response) {
+		t.Errorf("Expected only the masters response to be sent to the client")
+	}
+}
+
+func TestShardConnsMigrationWrites(t *testing.T) {
+	rt := testTable(t)
+	rt.ReplicationFactor = 1
+	rt, err := rt.Rebuild()
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	rt, err = rt.SetMigration(&shards.Migration{
+		Partition: 0,
+		From:      rt.Entries[0].Id(),
+		To:        rt.Entries[1].Id(),
+		Phase:     shards.MIGRATION_CATCHUP,
+	})
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	sc, protocol, conns := testShardConns(t, rt)
+	source, target := conns[rt.Entries[0].Id()], conns[rt.Entries[1].Id()]
+
+	//writes reach both entries
+	req := cheshire.NewRequest("/test", "POST")
+	req.Shard = &cheshire.ShardRequest{Partition: 0}
+	err = sc.send(req)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if protocol.writes[source.Writer] != 1 || protocol.writes[target.Writer] != 1 {
+		t.Errorf("Expected the write on both entries, source %d, target %d", protocol.writes[source.Writer], protocol.writes[target.Writer])
+	}
+	if req.Shard.Revision != rt.Revision {
+		t.Errorf("Expected revision %d on the request, got %d", rt.Revision, req.Shard.Revision)
+	}
+
+	//the targets response is dropped
+	response := cheshire.NewResponse(&cheshire.Txn{Request: req})
+	if !target.isMirrored(response) {
+		t.Errorf("Expected the migration targets response to be dropped")
+	}
+	if source.isMirrored(response) {
+		t.Errorf("Expected the sources response to be sent to the client")
+	}
+
+	//reads only go to the source
+	req = cheshire.NewRequest("/test", "GET")
+	req.Shard = &cheshire.ShardRequest{Partition: 0}
+	err = sc.send(req)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if protocol.writes[source.Writer] != 2 || protocol.writes[target.Writer] != 1 {
+		t.Errorf("Expected the read on the source only, source %d, target %d", protocol.writes[source.Writer], protocol.writes[target.Writer])
+	}
+}
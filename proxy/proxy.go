@@ -1,12 +1,16 @@
 package proxy
 
 import(
+    "bytes"
     "github.com/trendrr/goshire/cheshire"
     "io"
-    // "github.com/trendrr/goshire/dynmap"
+    "io/ioutil"
+    "github.com/trendrr/goshire/dynmap"
     "fmt"
     "log"
     "github.com/trendrr/goshire-shards/shards"
+    "strings"
+    "sync"
     "time"
 )
 // New proxy implementation
@@ -67,34 +71,73 @@ type Proxy struct {
     KillChan chan bool
     responseChan chan *resp
 
-    //Shard Connections indexed by Partition
-    Partitions []*Conn
+    //Shard Connections reads are sent to, indexed by Partition
+    Readers []*Conn
+    //Shard Connections writes are sent to, indexed by Partition
+    Writers []*Conn
+    //Connections to the other entries accepting writes (replicas and the target
+    //of an in flight migration), indexed by partition.
+    //writes are copied to these, and their responses dropped. see shards.RouterTable.WriteEntries
+    mirrors [][]*Conn
     //set of the available unique connections
     Conns []*Conn
 }
 
 // Returns the correct connection for the specified 
-// partition
-func (this *Proxy) Conn(partition int) (*Conn, error) {
-    if partition >= len(this.Partitions) || partition < 0 {
+// partition and request method (GET requests are reads)
+func (this *Proxy) Conn(partition int, method string) (*Conn, error) {
+    if partition >= len(this.Readers) || partition < 0 {
         return nil, fmt.Errorf("Partition out of range!")
     }
-    con := this.Partitions[partition]
+    con := this.Writers[partition]
+    if strings.ToUpper(method) == "GET" {
+        con = this.Readers[partition]
+    }
     if con == nil {
-        return nil, fmt.Errorf("No connection available at partition %d", partition)
+        return nil, fmt.Errorf("No connection available at partition %d for %s requests", partition, method)
     }
 
     return con, nil
 }
 
-func (this *Proxy) Partition(req cheshire.ShardRequest) (int, error) {
+// Returns the connections writes for this partition should
+// be copied to, empty if the partition has no other entry accepting writes.
+func (this *Proxy) Mirrors(partition int) []*Conn {
+    if partition >= len(this.mirrors) || partition < 0 {
+        return nil
+    }
+    return this.mirrors[partition]
+}
+
+// Finds the partition for the request.
+// if the request has no partition or shard key, the shard key is built 
+// from the params (the raw length prefixed params array).  encoding is the
+// param encoding of the request, only json params are supported.
+func (this *Proxy) Partition(req cheshire.ShardRequest, encoding string, params []byte) (int, error) {
     if req.Partition >= 0 {
-        if req.Partition >= len(this.Partitions) {
+        if req.Partition >= len(this.Readers) {
             return -1, fmt.Errorf("Partition out of range")
         }
         return req.Partition, nil
     }
-    partition, err := this.service.Partition(req.Key)
+    if len(req.Key) > 0 {
+        partition, err := this.service.Partition(req.Key)
+        return partition, err
+    }
+
+    if encoding != "json" {
+        return -1, fmt.Errorf("Unable to find shard key, unsupported param encoding %q", encoding)
+    }
+    str, err := cheshire.ReadString(bytes.NewReader(params))
+    if err != nil {
+        return -1, err
+    }
+    mp := dynmap.New()
+    err = mp.UnmarshalJSON([]byte(str))
+    if err != nil {
+        return -1, fmt.Errorf("Unable to find shard key, params are not json (%s)", err)
+    }
+    partition, err := this.service.PartitionParams(mp)
     return partition, err
 }
 
@@ -104,7 +147,9 @@ func NewProxy(service *Service, protocol Protocol) (*Proxy, error) {
 
     log.Println("NEW PROXY")
     px := &Proxy{
-        Partitions:   make([]*Conn, rt.TotalPartitions),
+        Readers:      make([]*Conn, rt.TotalPartitions),
+        Writers:      make([]*Conn, rt.TotalPartitions),
+        mirrors:      make([][]*Conn, rt.TotalPartitions),
         Conns:        make([]*Conn, 0),
         KillChan:     make(chan bool, 5),
         responseChan: make(chan *resp, 5),
@@ -112,7 +157,13 @@ func NewProxy(service *Service, protocol Protocol) (*Proxy, error) {
         protocol:     protocol,
     }
 
+    //connections by entry id
+    conns := make(map[string]*Conn)
     for _, e := range rt.Entries {
+        if e.EntryState() == shards.ENTRY_DOWN {
+            //nothing is routed to down entries
+            continue
+        }
         con, err := protocol.NewConn(px, e)
         if err != nil {
             log.Println(err)
@@ -121,15 +172,66 @@ func NewProxy(service *Service, protocol Protocol) (*Proxy, error) {
         }
         go con.start()
         px.Conns = append(px.Conns, con)
-
-        for _, p := range e.Partitions {
-            px.Partitions[p] = con
-        }
+        conns[e.Id()] = con
     }
+
+    px.route(rt, conns)
     go px.start()
     return px, nil
 }
 
+// Assigns the connections (by entry id) to the partitions, see routePartition
+func (this *Proxy) route(rt *shards.RouterTable, conns map[string]*Conn) {
+    for p := 0; p < rt.TotalPartitions; p++ {
+        r := routePartition(rt, p)
+        if r.read != nil {
+            this.Readers[p] = conns[r.read.Id()]
+        }
+        if r.write != nil {
+            this.Writers[p] = conns[r.write.Id()]
+        }
+        for _, e := range r.mirrors {
+            con, ok := conns[e.Id()]
+            if !ok {
+                log.Printf("No connection to %s, writes to partition %d will not be copied to it", e.Id(), p)
+                continue
+            }
+            this.mirrors[p] = append(this.mirrors[p], con)
+        }
+    }
+}
+
+// The entries requests for a partition are sent to
+type partitionRoute struct {
+    //the entry reads go to, nil if no entry accepts reads
+    read *shards.RouterEntry
+    //the entry writes go to, nil if no entry accepts writes
+    write *shards.RouterEntry
+    //the other entries accepting writes, they get a copy of the writes
+    mirrors []*shards.RouterEntry
+}
+
+// Finds the entries for the partition.  Reads go to the first entry in
+// RouterTable.ReadEntries and writes to the first in RouterTable.WriteEntries,
+// so a draining master still serves reads while its replica takes the writes.
+// Writes are copied to the rest of the WriteEntries, replicas apply writes
+// themselves, and during a migration the target gets every write made during the copy.
+func routePartition(rt *shards.RouterTable, partition int) partitionRoute {
+    r := partitionRoute{}
+    readers, _ := rt.ReadEntries(partition)
+    if len(readers) > 0 {
+        r.read = readers[0]
+    }
+    writers, _ := rt.WriteEntries(partition)
+    if len(writers) == 0 {
+        log.Printf("No entry accepting writes for partition %d", partition)
+        return r
+    }
+    r.write = writers[0]
+    r.mirrors = writers[1:]
+    return r
+}
+
 
 // Does the actual proxying
 //
@@ -164,6 +266,8 @@ func (this *Proxy) start() {
             }
 
             // partition is locked!
+            // services with a lock queue (see shards.Manager.LockQueueSize) hold the
+            // request until the unlock, so this is only seen when the queue is full or times out.
             if resp.response.StatusCode() == shards.E_PARTITION_LOCKED {
                 //TODO: ?
             }
@@ -221,6 +325,39 @@ type Conn struct {
     Entry    *shards.RouterEntry
     Port    int 
     proxy    *Proxy
+
+    //txn ids of requests copied to this connection (see Proxy.Mirrors)
+    mirrorTxns
+}
+
+// The txn ids of requests copied to a connection, the responses are dropped
+type mirrorTxns struct {
+    mirrored map[string]bool
+    lock sync.Mutex
+}
+
+// Marks the txn as a copy, so the responses are not sent to the client
+func (this *mirrorTxns) Mirror(txnId string) {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    if this.mirrored == nil {
+        this.mirrored = make(map[string]bool)
+    }
+    this.mirrored[txnId] = true
+}
+
+// checks if the response is for a copied request.
+// the txn is forgotten once it is complete
+func (this *mirrorTxns) isMirrored(response *cheshire.Response) bool {
+    this.lock.Lock()
+    defer this.lock.Unlock()
+    if !this.mirrored[response.TxnId()] {
+        return false
+    }
+    if response.TxnComplete() {
+        delete(this.mirrored, response.TxnId())
+    }
+    return true
 }
 
 func (this *Conn) start() {
@@ -236,6 +373,19 @@ func (this *Conn) start() {
             return
         }
 
+        if this.isMirrored(res.response) {
+            //read through the response without sending it on.
+            err = this.proxy.protocol.WriteResponse(res, ioutil.Discard)
+            if err != nil {
+                log.Print(err)
+                return
+            }
+            if res.response.StatusCode() != 200 {
+                log.Printf("Error from write copy on %s -- %d", this.Entry.Id(), res.response.StatusCode())
+            }
+            continue
+        }
+
         this.proxy.responseChan <- res
         select {
         case <-res.continueChan:
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"github.com/trendrr/goshire-shards/shards"
+	"testing"
+)
+
+// partition 0 is on entry1, partition 1 on entry2, each replicated to the other.
+func testTable(t *testing.T) *shards.RouterTable {
+	rt := shards.NewRouterTable("testdb")
+	rt.Revision = shards.NextRevision(0)
+	rt.TotalPartitions = 2
+	rt.ReplicationFactor = 2
+	rt.Entries = []*shards.RouterEntry{
+		&shards.RouterEntry{Address: "entry1", JsonPort: 8009, HttpPort: 8010, BinPort: 8011, Partitions: []int{0}},
+		&shards.RouterEntry{Address: "entry2", JsonPort: 8009, HttpPort: 8010, BinPort: 8011, Partitions: []int{1}},
+	}
+	rt, err := rt.Rebuild()
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	return rt
+}
+
+// a proxy with an unconnected Conn for every entry
+func testProxy(rt *shards.RouterTable) *Proxy {
+	px := &Proxy{
+		Readers: make([]*Conn, rt.TotalPartitions),
+		Writers: make([]*Conn, rt.TotalPartitions),
+		mirrors: make([][]*Conn, rt.TotalPartitions),
+	}
+	conns := make(map[string]*Conn)
+	for _, e := range rt.Entries {
+		conns[e.Id()] = &Conn{Entry: e, proxy: px}
+	}
+	px.route(rt, conns)
+	return px
+}
+
+func connEntry(t *testing.T, px *Proxy, partition int, method string) string {
+	con, err := px.Conn(partition, method)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	return con.Entry.Address
+}
+
+func TestDrainingMasterRouting(t *testing.T) {
+	rt := testTable(t)
+	rt.Entries[0].State = shards.ENTRY_DRAINING
+	rt, err := rt.Rebuild()
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	px := testProxy(rt)
+
+	//the draining master still serves reads, its active replica takes the writes
+	if e := connEntry(t, px, 0, "GET"); e != "entry1" {
+		t.Errorf("Expected partition 0 reads to go to entry1, got %s", e)
+	}
+	if e := connEntry(t, px, 0, "POST"); e != "entry2" {
+		t.Errorf("Expected partition 0 writes to go to entry2, got %s", e)
+	}
+	if e := connEntry(t, px, 1, "PUT"); e != "entry2" {
+		t.Errorf("Expected partition 1 writes to go to entry2, got %s", e)
+	}
+	if len(px.Mirrors(0)) != 0 {
+		t.Errorf("Expected no copies, the draining master does not take writes")
+	}
+
+	//nothing takes writes once the replica is down too
+	rt.Entries[1].State = shards.ENTRY_DOWN
+	rt, err = rt.Rebuild()
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	px = testProxy(rt)
+	if _, err := px.Conn(0, "POST"); err == nil {
+		t.Errorf("Expected no connection for writes when no entry accepts them")
+	}
+	if e := connEntry(t, px, 0, "GET"); e != "entry1" {
+		t.Errorf("Expected partition 0 reads to go to entry1, got %s", e)
+	}
+}
+
+func TestReplicaWrites(t *testing.T) {
+	px := testProxy(testTable(t))
+
+	//writes go to the master, and are copied to the replica
+	if e := connEntry(t, px, 0, "POST"); e != "entry1" {
+		t.Errorf("Expected partition 0 writes to go to entry1, got %s", e)
+	}
+	mirrors := px.Mirrors(0)
+	if len(mirrors) != 1 || mirrors[0].Entry.Address != "entry2" {
+		t.Errorf("Expected partition 0 writes to be copied to entry2, got %v", mirrors)
+	}
+	mirrors = px.Mirrors(1)
+	if len(mirrors) != 1 || mirrors[0].Entry.Address != "entry1" {
+		t.Errorf("Expected partition 1 writes to be copied to entry1, got %v", mirrors)
+	}
+}
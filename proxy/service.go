@@ -4,13 +4,13 @@ import (
 	"fmt"
 	"github.com/trendrr/goshire-shards/shards"
 	"github.com/trendrr/goshire/client"
+	"github.com/trendrr/goshire/dynmap"
 )
 
 // Handles the connections for a single service.
 
 type Service struct {
 	connections *shards.Connections
-	hasher      Hasher
 }
 
 // creates a new client from seed urls.
@@ -22,7 +22,6 @@ func NewService(rt *shards.RouterTable) (*Service, error) {
 	connections.SetRouterTable(rt)
 
 	service.connections = connections
-	service.hasher = &DefaultHasher{}
 	return service, nil
 }
 
@@ -30,17 +29,40 @@ func (this *Service) RouterTable() *shards.RouterTable {
 	return this.connections.RouterTable()
 }
 
+// Finds the partition for the shard key, using the router tables hash algorithm
 func (this *Service) Partition(key string) (int, error) {
-	partition, err := this.hasher.Hash(key, this.connections.RouterTable().TotalPartitions)
+	partition, err := this.connections.RouterTable().Partition(key)
 	return partition, err
 }
 
+// Finds the partition from the request params, using the
+// shard key param, or the router table partition keys.
+func (this *Service) PartitionParams(params *dynmap.DynMap) (int, error) {
+	key, err := this.connections.RouterTable().ShardKey(params)
+	if err != nil {
+		return -1, err
+	}
+	return this.Partition(key)
+}
+
 //gets the entries for a partition.
 func (this *Service) Entries(partition int) ([]*shards.EntryClient, error) {
 	v, err := this.connections.Entries(partition)
 	return v, err
 }
 
+//gets the entries for a partition that accept reads
+func (this *Service) ReadEntries(partition int) ([]*shards.EntryClient, error) {
+	v, err := this.connections.ReadEntries(partition)
+	return v, err
+}
+
+//gets the entries for a partition that accept writes
+func (this *Service) WriteEntries(partition int) ([]*shards.EntryClient, error) {
+	v, err := this.connections.WriteEntries(partition)
+	return v, err
+}
+
 func (this *Service) Close() {
 	this.connections.Close()
 }
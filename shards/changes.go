@@ -0,0 +1,25 @@
+package shards
+
+import (
+	"io"
+)
+
+// Optional interface a Shard can implement for online migrations.
+// The bulk copy of a partition happens unlocked, then only the changes made
+// during the copy are sent while the partition is locked (see PARTITION_MARKER).
+//
+// Markers are opaque to the manager, the shard decides what they are (a log offset,
+// a timestamp..).
+type DeltaShard interface {
+	// Returns a marker for the current state of the partition.
+	// Changes made after this call must be exported by ExportPartitionChanges(partition, marker)
+	PartitionMarker(partition int) (string, error)
+
+	// Exports the changes (including deletes) made to the partition since the marker.
+	ExportPartitionChanges(partition int, marker string, writer io.Writer, finished chan int64, errorChan chan error)
+
+	// Applies a stream produced by ExportPartitionChanges.
+	// The target may already have some of the changes (writes are sent to both entries during a migration),
+	// so applying a change twice must be harmless.
+	ImportPartitionChanges(partition int, reader io.Reader, finished chan int64, errorChan chan error)
+}
@@ -0,0 +1,132 @@
+package shards
+
+import (
+	"fmt"
+	"github.com/trendrr/goshire/dynmap"
+	"io"
+	"os"
+	"strconv"
+)
+
+// Optional interface a Shard can implement so interrupted partition copies
+// resume instead of starting over.
+//
+// Tokens are opaque to the manager, the shard decides what they are (a key, a file offset..)
+// and how they are carried in the export stream.
+type ResumableShard interface {
+	// Exports the data for the partition that comes after the token.
+	// an empty token exports everything.
+	ExportPartitionFrom(partition int, token string, writer io.Writer, finished chan int64, errorChan chan error)
+
+	// Imports a stream produced by ExportPartitionFrom(partition, token).
+	// Should send a token on checkpoints whenever everything up to that token has been
+	// durably imported.  The manager saves the latest one and resumes the export from
+	// it if the copy is interrupted.
+	ImportPartitionFrom(partition int, token string, reader io.Reader, checkpoints chan string, finished chan int64, errorChan chan error)
+}
+
+// Where an interrupted import should resume from
+type Checkpoint struct {
+	Partition int
+	//the http address the partition is being imported from
+	Source string
+	Token  string
+}
+
+// Returns the saved checkpoint for importing the partition from the source.
+func (this *Manager) Checkpoint(partition int, source string) (*Checkpoint, bool) {
+	this.checkpointLock.Lock()
+	defer this.checkpointLock.Unlock()
+	checkpoints, err := this.loadCheckpoints()
+	if err != nil {
+		return nil, false
+	}
+	c, ok := checkpoints[partition]
+	if !ok || c.Source != source {
+		return nil, false
+	}
+	return c, true
+}
+
+// Saves the checkpoint, replacing any other checkpoint for the partition.
+func (this *Manager) SaveCheckpoint(checkpoint *Checkpoint) error {
+	this.checkpointLock.Lock()
+	defer this.checkpointLock.Unlock()
+	checkpoints, err := this.loadCheckpoints()
+	if err != nil {
+		return err
+	}
+	checkpoints[checkpoint.Partition] = checkpoint
+	return this.saveCheckpoints(checkpoints)
+}
+
+// Removes the checkpoint for the partition, once the import is finished (or
+// is being started over)
+func (this *Manager) ClearCheckpoint(partition int) error {
+	this.checkpointLock.Lock()
+	defer this.checkpointLock.Unlock()
+	checkpoints, err := this.loadCheckpoints()
+	if err != nil {
+		return err
+	}
+	if _, ok := checkpoints[partition]; !ok {
+		return nil
+	}
+	delete(checkpoints, partition)
+	return this.saveCheckpoints(checkpoints)
+}
+
+func (this *Manager) checkpointsFilename() string {
+	if this.DataDir == "" {
+		return fmt.Sprintf("%s.checkpoints", this.ServiceName)
+	}
+	return fmt.Sprintf("%s%c%s.checkpoints", this.DataDir, os.PathSeparator, this.ServiceName)
+}
+
+// caller should hold the checkpointLock
+func (this *Manager) loadCheckpoints() (map[int]*Checkpoint, error) {
+	checkpoints := make(map[int]*Checkpoint)
+	mp := dynmap.NewDynMap()
+	_, err := ReadFileSafe(this.checkpointsFilename(), 1, func(bytes []byte) error {
+		mp = dynmap.NewDynMap()
+		return mp.UnmarshalJSON(bytes)
+	})
+	if os.IsNotExist(err) {
+		return checkpoints, nil
+	}
+	if err != nil {
+		return checkpoints, err
+	}
+	for k, _ := range mp.Map {
+		partition, err := strconv.Atoi(k)
+		if err != nil {
+			continue
+		}
+		cm, ok := mp.GetDynMap(k)
+		if !ok {
+			continue
+		}
+		checkpoints[partition] = &Checkpoint{
+			Partition: partition,
+			Source:    cm.MustString("source", ""),
+			Token:     cm.MustString("token", ""),
+		}
+	}
+	return checkpoints, nil
+}
+
+// caller should hold the checkpointLock
+func (this *Manager) saveCheckpoints(checkpoints map[int]*Checkpoint) error {
+	mp := dynmap.NewDynMap()
+	for p, c := range checkpoints {
+		cm := dynmap.NewDynMap()
+		cm.Put("source", c.Source)
+		cm.Put("token", c.Token)
+		mp.Put(strconv.Itoa(p), cm)
+	}
+	bytes, err := mp.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	return WriteFileSafe(this.checkpointsFilename(), bytes, 1)
+}
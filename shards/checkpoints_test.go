@@ -0,0 +1,46 @@
+package shards
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCheckpoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shards-checkpoints")
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	defer os.RemoveAll(dir)
+	manager := &Manager{ServiceName: "test", DataDir: dir}
+
+	if _, ok := manager.Checkpoint(3, "http://localhost:8010"); ok {
+		t.Errorf("Expected no checkpoint")
+	}
+
+	err = manager.SaveCheckpoint(&Checkpoint{Partition: 3, Source: "http://localhost:8010", Token: "key100"})
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	err = manager.SaveCheckpoint(&Checkpoint{Partition: 3, Source: "http://localhost:8010", Token: "key200"})
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	manager.SaveCheckpoint(&Checkpoint{Partition: 4, Source: "http://localhost:8010", Token: "key5"})
+
+	c, ok := manager.Checkpoint(3, "http://localhost:8010")
+	if !ok || c.Token != "key200" {
+		t.Errorf("Expected the latest checkpoint, got %v", c)
+	}
+	if _, ok := manager.Checkpoint(3, "http://otherhost:8010"); ok {
+		t.Errorf("Expected no checkpoint for a different source")
+	}
+
+	manager.ClearCheckpoint(3)
+	if _, ok := manager.Checkpoint(3, "http://localhost:8010"); ok {
+		t.Errorf("Expected checkpoint to be cleared")
+	}
+	if c, ok := manager.Checkpoint(4, "http://localhost:8010"); !ok || c.Token != "key5" {
+		t.Errorf("Expected other partitions to keep their checkpoint")
+	}
+}
@@ -0,0 +1,60 @@
+package shards
+
+import (
+	"fmt"
+	"github.com/trendrr/goshire/dynmap"
+)
+
+// Optional interface a Shard can implement so the admin can verify
+// a partition copy before deleting the original.
+type ChecksumShard interface {
+	// Returns the checksum of all the data in the partition.
+	// The digest must not depend on the order the data is stored in, two shards
+	// holding the same records for a partition must return the same digest.
+	PartitionChecksum(partition int) (*Checksum, error)
+}
+
+// A summary of the data in a partition
+type Checksum struct {
+	//the number of records
+	Count int64
+	//the shard specific digest of the records
+	Digest string
+}
+
+func ToChecksum(mp *dynmap.DynMap) (*Checksum, error) {
+	c := &Checksum{}
+	var ok bool
+	c.Count, ok = mp.GetInt64("count")
+	if !ok {
+		return nil, fmt.Errorf("No count in checksum %s", mp)
+	}
+	c.Digest, ok = mp.GetString("digest")
+	if !ok {
+		return nil, fmt.Errorf("No digest in checksum %s", mp)
+	}
+	return c, nil
+}
+
+// Translate to a DynMap of the form:
+// {
+//     "count" : 4056,
+//     "digest" : "9e107d9d372bb6826bd81d3542a419d6"
+// }
+func (this *Checksum) ToDynMap() *dynmap.DynMap {
+	mp := dynmap.NewDynMap()
+	mp.Put("count", this.Count)
+	mp.Put("digest", this.Digest)
+	return mp
+}
+
+func (this *Checksum) Equals(other *Checksum) bool {
+	if other == nil {
+		return false
+	}
+	return this.Count == other.Count && this.Digest == other.Digest
+}
+
+func (this *Checksum) String() string {
+	return fmt.Sprintf("%d records (%s)", this.Count, this.Digest)
+}
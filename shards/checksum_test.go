@@ -0,0 +1,25 @@
+package shards
+
+import (
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	c := &Checksum{Count: 4056, Digest: "9e107d9d372bb6826bd81d3542a419d6"}
+	parsed, err := ToChecksum(c.ToDynMap())
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if !c.Equals(parsed) {
+		t.Errorf("Expected %s, got %s", c, parsed)
+	}
+	if c.Equals(&Checksum{Count: 4055, Digest: c.Digest}) {
+		t.Errorf("Expected different counts not to be equal")
+	}
+	if c.Equals(&Checksum{Count: c.Count, Digest: "d41d8cd98f00b204e9800998ecf8427e"}) {
+		t.Errorf("Expected different digests not to be equal")
+	}
+	if c.Equals(nil) {
+		t.Errorf("Expected nil not to be equal")
+	}
+}
@@ -0,0 +1,400 @@
+// A standard record stream for partition export and import.
+//
+// Shards are free to use any format for ExportPartition and ImportPartition, this
+// one exists so they dont have to invent one.  A stream is:
+//
+//     header  : magic "SHRD" | version uint16 | partition int32 | crc32 uint32
+//     blocks  : length uint32 | records uint32 | payload | crc32 uint32
+//     end     : a block with length 0 and records 0
+//     trailer : records uint64 | blocks uint64 | bytes uint64 | crc32 uint32
+//
+// Each record in a block payload is:
+//
+//     type byte | key length uint32 | key | value length uint32 | value | metadata length uint32 | metadata
+//
+// All integers are big endian, the checksums are crc32 (IEEE).  The block crc covers
+// the record count and the payload.
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	MAGIC   = "SHRD"
+	VERSION = 1
+
+	// Blocks are written once they reach this size
+	DEFAULT_BLOCK_SIZE = 64 * 1024
+
+	// Larger blocks are considered corrupt, so a damaged length can not make us allocate gigs
+	MAX_BLOCK_SIZE = 64 * 1024 * 1024
+)
+
+// Record types
+const (
+	RECORD_PUT    byte = 0
+	RECORD_DELETE byte = 1
+)
+
+var (
+	// The stream failed a checksum or is not a record stream
+	ErrCorrupt = errors.New("corrupt record stream")
+
+	// The stream ended before the trailer
+	ErrTruncated = errors.New("truncated record stream")
+
+	// A single record is larger than MAX_BLOCK_SIZE, so no reader would accept it
+	ErrRecordTooLarge = errors.New("record is larger than the max block size")
+)
+
+type Record struct {
+	Type     byte
+	Key      []byte
+	Value    []byte
+	Metadata []byte
+}
+
+// The counts written at the end of a stream
+type Trailer struct {
+	Records int64
+	Blocks  int64
+	//payload bytes, not including the framing
+	Bytes int64
+}
+
+type Writer struct {
+	writer  io.Writer
+	block   bytes.Buffer
+	count   int
+	trailer Trailer
+	written int64
+	closed  bool
+	//blocks are written once they reach this size, must be between 1 and MAX_BLOCK_SIZE
+	BlockSize int
+}
+
+// Creates a new writer and writes the header.
+func NewWriter(writer io.Writer, partition int) (*Writer, error) {
+	w := &Writer{
+		writer:    writer,
+		BlockSize: DEFAULT_BLOCK_SIZE,
+	}
+	header := make([]byte, 10, 14)
+	copy(header, MAGIC)
+	binary.BigEndian.PutUint16(header[4:], VERSION)
+	binary.BigEndian.PutUint32(header[6:], uint32(int32(partition)))
+	header = appendUint32(header, crc32.ChecksumIEEE(header))
+	err := w.write(header)
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Adds a record to the stream.  Records are buffered until the block is full.
+func (this *Writer) Write(record *Record) error {
+	if this.closed {
+		return fmt.Errorf("Writer is closed")
+	}
+	if this.BlockSize <= 0 || this.BlockSize > MAX_BLOCK_SIZE {
+		return fmt.Errorf("BlockSize %d must be between 1 and %d", this.BlockSize, MAX_BLOCK_SIZE)
+	}
+	if !validType(record.Type) {
+		return fmt.Errorf("Unknown record type %d", record.Type)
+	}
+	buf := make([]byte, 0, 13+len(record.Key)+len(record.Value)+len(record.Metadata))
+	buf = append(buf, record.Type)
+	buf = appendBytes(buf, record.Key)
+	buf = appendBytes(buf, record.Value)
+	buf = appendBytes(buf, record.Metadata)
+	if len(buf) > MAX_BLOCK_SIZE {
+		return ErrRecordTooLarge
+	}
+	if this.block.Len()+len(buf) > MAX_BLOCK_SIZE {
+		//would make a block the reader rejects, so end this one first
+		err := this.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	this.block.Write(buf)
+	this.count++
+	if this.block.Len() >= this.BlockSize {
+		return this.Flush()
+	}
+	return nil
+}
+
+// Writes a put record
+func (this *Writer) Put(key, value, metadata []byte) error {
+	return this.Write(&Record{Type: RECORD_PUT, Key: key, Value: value, Metadata: metadata})
+}
+
+// Writes a delete record
+func (this *Writer) Delete(key []byte) error {
+	return this.Write(&Record{Type: RECORD_DELETE, Key: key})
+}
+
+// Writes the buffered records as a block
+func (this *Writer) Flush() error {
+	if this.count == 0 {
+		return nil
+	}
+	err := this.writeBlock(this.block.Bytes(), this.count)
+	if err != nil {
+		return err
+	}
+	this.trailer.Records += int64(this.count)
+	this.trailer.Blocks++
+	this.trailer.Bytes += int64(this.block.Len())
+	this.block.Reset()
+	this.count = 0
+	return nil
+}
+
+// Flushes the last block and writes the trailer.
+// Does not close the underlying writer.
+func (this *Writer) Close() error {
+	if this.closed {
+		return nil
+	}
+	err := this.Flush()
+	if err != nil {
+		return err
+	}
+	err = this.writeBlock(nil, 0)
+	if err != nil {
+		return err
+	}
+	trailer := make([]byte, 24, 28)
+	binary.BigEndian.PutUint64(trailer[0:], uint64(this.trailer.Records))
+	binary.BigEndian.PutUint64(trailer[8:], uint64(this.trailer.Blocks))
+	binary.BigEndian.PutUint64(trailer[16:], uint64(this.trailer.Bytes))
+	trailer = appendUint32(trailer, crc32.ChecksumIEEE(trailer))
+	err = this.write(trailer)
+	if err != nil {
+		return err
+	}
+	this.closed = true
+	return nil
+}
+
+// The total number of bytes written to the underlying writer
+func (this *Writer) Written() int64 {
+	return this.written
+}
+
+// The counts so far.  only includes flushed records
+func (this *Writer) Trailer() Trailer {
+	return this.trailer
+}
+
+func (this *Writer) writeBlock(payload []byte, count int) error {
+	frame := make([]byte, 8, 8+len(payload)+4)
+	binary.BigEndian.PutUint32(frame[0:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], uint32(count))
+	frame = append(frame, payload...)
+	frame = appendUint32(frame, crc32.ChecksumIEEE(frame[4:]))
+	return this.write(frame)
+}
+
+func (this *Writer) write(buf []byte) error {
+	n, err := this.writer.Write(buf)
+	this.written += int64(n)
+	return err
+}
+
+// Reads a record stream.
+// Records are only returned once the block they are in has passed its checksum, and
+// io.EOF is only returned once the trailer matches what was read.  Any other error
+// means the stream is corrupt or truncated, so an import that stages the records and
+// only commits them on io.EOF never applies half a transfer.
+type Reader struct {
+	reader    io.Reader
+	partition int
+	records   []*Record
+	trailer   Trailer
+	read      int64
+	done      bool
+}
+
+// Creates a new reader, reading and checking the header.
+func NewReader(reader io.Reader) (*Reader, error) {
+	r := &Reader{reader: reader}
+	header := make([]byte, 14)
+	err := r.readFull(header)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[0:4]) != MAGIC {
+		return nil, ErrCorrupt
+	}
+	if binary.BigEndian.Uint32(header[10:]) != crc32.ChecksumIEEE(header[0:10]) {
+		return nil, ErrCorrupt
+	}
+	version := binary.BigEndian.Uint16(header[4:])
+	if version != VERSION {
+		return nil, fmt.Errorf("Unsupported record stream version %d", version)
+	}
+	r.partition = int(int32(binary.BigEndian.Uint32(header[6:])))
+	return r, nil
+}
+
+// The partition from the header
+func (this *Reader) Partition() int {
+	return this.partition
+}
+
+// Returns the next record, or io.EOF at the end of a complete stream
+func (this *Reader) Read() (*Record, error) {
+	for len(this.records) == 0 {
+		if this.done {
+			return nil, io.EOF
+		}
+		err := this.readBlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	record := this.records[0]
+	this.records = this.records[1:]
+	return record, nil
+}
+
+// The total number of bytes read from the underlying reader
+func (this *Reader) BytesRead() int64 {
+	return this.read
+}
+
+// The counts so far
+func (this *Reader) Trailer() Trailer {
+	return this.trailer
+}
+
+func (this *Reader) readBlock() error {
+	frame := make([]byte, 8)
+	err := this.readFull(frame)
+	if err != nil {
+		return err
+	}
+	length := binary.BigEndian.Uint32(frame[0:])
+	count := binary.BigEndian.Uint32(frame[4:])
+	if length > MAX_BLOCK_SIZE {
+		return ErrCorrupt
+	}
+	block := make([]byte, 4+int(length)+4)
+	copy(block, frame[4:])
+	err = this.readFull(block[4:])
+	if err != nil {
+		return err
+	}
+	crc := binary.BigEndian.Uint32(block[len(block)-4:])
+	if crc != crc32.ChecksumIEEE(block[:len(block)-4]) {
+		return ErrCorrupt
+	}
+	if length == 0 {
+		if count != 0 {
+			return ErrCorrupt
+		}
+		return this.readTrailer()
+	}
+
+	records, err := decodeRecords(block[4:len(block)-4], int(count))
+	if err != nil {
+		return err
+	}
+	this.records = records
+	this.trailer.Records += int64(count)
+	this.trailer.Blocks++
+	this.trailer.Bytes += int64(length)
+	return nil
+}
+
+func (this *Reader) readTrailer() error {
+	buf := make([]byte, 28)
+	err := this.readFull(buf)
+	if err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(buf[24:]) != crc32.ChecksumIEEE(buf[:24]) {
+		return ErrCorrupt
+	}
+	trailer := Trailer{
+		Records: int64(binary.BigEndian.Uint64(buf[0:])),
+		Blocks:  int64(binary.BigEndian.Uint64(buf[8:])),
+		Bytes:   int64(binary.BigEndian.Uint64(buf[16:])),
+	}
+	if trailer != this.trailer {
+		return fmt.Errorf("%s: trailer has %d records in %d blocks, read %d in %d", ErrCorrupt, trailer.Records, trailer.Blocks, this.trailer.Records, this.trailer.Blocks)
+	}
+	this.done = true
+	return nil
+}
+
+func (this *Reader) readFull(buf []byte) error {
+	n, err := io.ReadFull(this.reader, buf)
+	this.read += int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	}
+	return err
+}
+
+func decodeRecords(payload []byte, count int) ([]*Record, error) {
+	records := make([]*Record, 0, count)
+	for len(payload) > 0 {
+		record := &Record{Type: payload[0]}
+		if !validType(record.Type) {
+			return nil, ErrCorrupt
+		}
+		payload = payload[1:]
+		var ok bool
+		if record.Key, payload, ok = readBytes(payload); !ok {
+			return nil, ErrCorrupt
+		}
+		if record.Value, payload, ok = readBytes(payload); !ok {
+			return nil, ErrCorrupt
+		}
+		if record.Metadata, payload, ok = readBytes(payload); !ok {
+			return nil, ErrCorrupt
+		}
+		records = append(records, record)
+	}
+	if len(records) != count {
+		return nil, ErrCorrupt
+	}
+	return records, nil
+}
+
+func validType(t byte) bool {
+	return t == RECORD_PUT || t == RECORD_DELETE
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func appendBytes(buf []byte, v []byte) []byte {
+	buf = appendUint32(buf, uint32(len(v)))
+	return append(buf, v...)
+}
+
+func readBytes(buf []byte) ([]byte, []byte, bool) {
+	if len(buf) < 4 {
+		return nil, buf, false
+	}
+	length := binary.BigEndian.Uint32(buf)
+	buf = buf[4:]
+	if uint64(length) > uint64(len(buf)) {
+		return nil, buf, false
+	}
+	return buf[:length], buf[length:], true
+}
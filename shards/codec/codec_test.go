@@ -0,0 +1,200 @@
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func writeStream(t *testing.T, records int) []byte {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, 7)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	w.BlockSize = 100
+	for i := 0; i < records; i++ {
+		err = w.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i)), nil)
+		if err != nil {
+			t.Fatalf("Error %s", err)
+		}
+	}
+	w.Delete([]byte("gone"))
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if w.Written() != int64(buf.Len()) {
+		t.Errorf("Expected %d bytes written, got %d", buf.Len(), w.Written())
+	}
+	return buf.Bytes()
+}
+
+func readStream(data []byte) ([]*Record, error) {
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*Record, 0)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	data := writeStream(t, 50)
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if r.Partition() != 7 {
+		t.Errorf("Expected partition 7, got %d", r.Partition())
+	}
+
+	records, err := readStream(data)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if len(records) != 51 {
+		t.Fatalf("Expected 51 records, got %d", len(records))
+	}
+	if string(records[12].Key) != "key12" || string(records[12].Value) != "value12" || records[12].Type != RECORD_PUT {
+		t.Errorf("Unexpected record %s=%s", records[12].Key, records[12].Value)
+	}
+	if string(records[50].Key) != "gone" || records[50].Type != RECORD_DELETE {
+		t.Errorf("Expected a delete for gone, got %s", records[50].Key)
+	}
+}
+
+func TestEmptyStream(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf, 0)
+	w.Close()
+	records, err := readStream(buf.Bytes())
+	if err != nil || len(records) != 0 {
+		t.Errorf("Expected no records, got %d (%v)", len(records), err)
+	}
+}
+
+func TestCorruptStream(t *testing.T) {
+	data := writeStream(t, 50)
+
+	//flip a byte in the middle of a block
+	corrupt := append([]byte{}, data...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	_, err := readStream(corrupt)
+	if err != ErrCorrupt {
+		t.Errorf("Expected a corrupt stream, got %v", err)
+	}
+
+	for _, length := range []int{0, 10, len(data) / 2, len(data) - 1} {
+		_, err = readStream(data[:length])
+		if err != ErrTruncated {
+			t.Errorf("Expected a truncated stream at %d bytes, got %v", length, err)
+		}
+	}
+
+	_, err = readStream([]byte("this is not a record stream"))
+	if err != ErrCorrupt {
+		t.Errorf("Expected a corrupt stream, got %v", err)
+	}
+}
+
+func TestWriterLimits(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, 7)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	for _, size := range []int{0, -1, MAX_BLOCK_SIZE + 1} {
+		w.BlockSize = size
+		if w.Put([]byte("key"), []byte("value"), nil) == nil {
+			t.Errorf("Expected block size %d to be rejected", size)
+		}
+	}
+	w.BlockSize = MAX_BLOCK_SIZE
+
+	if w.Write(&Record{Type: 5, Key: []byte("key")}) == nil {
+		t.Errorf("Expected an unknown record type to be rejected")
+	}
+
+	err = w.Put([]byte("key"), make([]byte, MAX_BLOCK_SIZE), nil)
+	if err != ErrRecordTooLarge {
+		t.Errorf("Expected %s, got %v", ErrRecordTooLarge, err)
+	}
+
+	//records that fit on their own but not together go in separate blocks
+	half := make([]byte, MAX_BLOCK_SIZE/2)
+	for i := 0; i < 2; i++ {
+		err = w.Put([]byte(fmt.Sprintf("key%d", i)), half, nil)
+		if err != nil {
+			t.Fatalf("Error %s", err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if w.Trailer().Blocks != 2 {
+		t.Errorf("Expected 2 blocks, got %d", w.Trailer().Blocks)
+	}
+	records, err := readStream(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if len(records) != 2 {
+		t.Errorf("Expected 2 records, got %d", len(records))
+	}
+}
+
+func TestUnknownRecordType(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, 7)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	payload := []byte{5}
+	payload = appendBytes(payload, []byte("key"))
+	payload = appendBytes(payload, nil)
+	payload = appendBytes(payload, nil)
+	err = w.writeBlock(payload, 1)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	_, err = readStream(buf.Bytes())
+	if err != ErrCorrupt {
+		t.Errorf("Expected a corrupt stream, got %v", err)
+	}
+}
+
+func TestCounter(t *testing.T) {
+	data := writeStream(t, 50)
+	counter := NewCounter(bytes.NewReader(data))
+	//read in small pieces, so frames are split between reads
+	buf := make([]byte, 7)
+	for {
+		_, err := counter.Read(buf)
+		if err != nil {
+			break
+		}
+	}
+	records, ok := counter.Records()
+	if !ok || records != 51 {
+		t.Errorf("Expected 51 records, got %d (%v)", records, ok)
+	}
+
+	counter = NewCounter(bytes.NewReader([]byte("this is not a record stream")))
+	ioutil.ReadAll(counter)
+	if _, ok := counter.Records(); ok {
+		t.Errorf("Expected a plain stream not to be counted")
+	}
+}
@@ -0,0 +1,101 @@
+package codec
+
+import (
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+)
+
+const (
+	countHeader = iota
+	countFrame
+	countSkip
+	countDone
+)
+
+// Counts the records in a stream as it is read through, without decoding it.
+// This is for progress reporting only, nothing is verified (see Reader).
+// Streams that are not record streams are passed through untouched.
+type Counter struct {
+	reader  io.Reader
+	records int64
+	//1 once the header matched, -1 if it did not
+	stream int32
+
+	state   int
+	pending []byte
+	skip    int64
+}
+
+func NewCounter(reader io.Reader) *Counter {
+	return &Counter{reader: reader}
+}
+
+func (this *Counter) Read(p []byte) (int, error) {
+	n, err := this.reader.Read(p)
+	this.scan(p[:n])
+	return n, err
+}
+
+// Returns the number of records read so far, and false if this
+// is not (or not yet known to be) a record stream.
+// safe to call from another goroutine.
+func (this *Counter) Records() (int64, bool) {
+	return atomic.LoadInt64(&this.records), atomic.LoadInt32(&this.stream) == 1
+}
+
+func (this *Counter) scan(data []byte) {
+	for len(data) > 0 && this.state != countDone {
+		switch this.state {
+		case countHeader:
+			data = this.fill(data, 14)
+			if len(this.pending) < 14 {
+				return
+			}
+			if string(this.pending[0:4]) != MAGIC {
+				atomic.StoreInt32(&this.stream, -1)
+				this.state = countDone
+				return
+			}
+			atomic.StoreInt32(&this.stream, 1)
+			this.pending = nil
+			this.state = countFrame
+		case countFrame:
+			data = this.fill(data, 8)
+			if len(this.pending) < 8 {
+				return
+			}
+			length := binary.BigEndian.Uint32(this.pending[0:])
+			count := binary.BigEndian.Uint32(this.pending[4:])
+			this.pending = nil
+			if length == 0 {
+				//the trailer follows
+				this.state = countDone
+				return
+			}
+			atomic.AddInt64(&this.records, int64(count))
+			this.skip = int64(length) + 4
+			this.state = countSkip
+		case countSkip:
+			k := this.skip
+			if k > int64(len(data)) {
+				k = int64(len(data))
+			}
+			data = data[k:]
+			this.skip -= k
+			if this.skip == 0 {
+				this.state = countFrame
+			}
+		}
+	}
+}
+
+// moves bytes from data into pending until it has size bytes, returns the rest of data
+func (this *Counter) fill(data []byte, size int) []byte {
+	need := size - len(this.pending)
+	if need > len(data) {
+		need = len(data)
+	}
+	this.pending = append(this.pending, data[:need]...)
+	return data[need:]
+}
@@ -147,6 +147,42 @@ func (this *Connections) Entries(partition int) ([]*EntryClient, error) {
 	return this.connections[partition], nil
 }
 
+// Returns the entries for this partition that accept reads (see RouterTable.ReadEntries)
+// in order of preference.  During a migration this is only the source.
+func (this *Connections) ReadEntries(partition int) ([]*EntryClient, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	entries, err := this.table.ReadEntries(partition)
+	if err != nil {
+		return nil, err
+	}
+	return this.entryClients(entries), nil
+}
+
+// Returns the entries for this partition that accept writes (see RouterTable.WriteEntries)
+// During a migration this includes the target.
+func (this *Connections) WriteEntries(partition int) ([]*EntryClient, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	entries, err := this.table.WriteEntries(partition)
+	if err != nil {
+		return nil, err
+	}
+	return this.entryClients(entries), nil
+}
+
+// caller should hold the lock
+func (this *Connections) entryClients(entries []*RouterEntry) []*EntryClient {
+	clients := make([]*EntryClient, 0, len(entries))
+	for _, e := range entries {
+		c, ok := this.entries[e.Id()]
+		if ok {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
 // Sets the client creator
 func (this *Connections) SetClientCreator(c ClientCreator) {
 	this.lock.Lock()
@@ -229,6 +265,7 @@ func (this *Connections) SetRouterTable(table *RouterTable) (*RouterTable, error
 	this.entries = c
 	this.connections = connections
 	this.table = table
+	ObserveRevision(table.Revision)
 
 	//non-blocking channel send.
 	select {
@@ -17,17 +17,44 @@ const (
 	// @param router_table The router table
 	ROUTERTABLE_SET = "/__c/rt/set"
 
+	// Takes (or renews) a lease on the partition. see PartitionLock
+	// returns
+	// {
+	//  "lock" : <the lock, includes the fencing token>
+	// }
 	// @method POST
 	// @param partition
+	// @param owner who is locking (the same owner can renew)
+	// @param ttl lease in seconds (optional)
 	PARTITION_LOCK   = "/__c/pt/lock"
 	
 	// @method POST
 	// @param partition
+	// @param token the fencing token from the lock
 	PARTITION_UNLOCK = "/__c/pt/unlock"
 
+	// Lists the current partition locks
+	// {
+	//  "locks" : [<lock>, <lock>]
+	// }
+	// @method GET
+	//
+	// Force releases a lock, regardless of owner
+	// @method DELETE
+	// @param partition
+	PARTITION_LOCKS = "/__c/pt/locks"
+
+	// Splits every partition on this server into its children and then
+	// sets the new router table.  see RouterTable.Split
+	// @method POST
+	// @param router_table The new (split) router table
+	PARTITION_SPLIT = "/__c/pt/split"
+
 	// Delete a partition from this server
 	// @method DELETE
 	// @param partition
+	// @param lock_token if present the partition must be locked with this token
+	// @param _v if present our router table must be at least this revision, and the partition not ours
 	PARTITION_DELETE = "/__c/pt/delete"
 
 	// Is a ping endpoint to check for liveness and
@@ -37,6 +64,9 @@ const (
 	//  "strest" :{...}
 	//  "ts" : <ISOFORMATED TIMESTAMP>
 	//  "rt_revision" : <router table revision>
+	//  "node_id" : <the node id of this server>
+	//  "entry_id" : <the id of this servers entry in the router table>
+	//  "identity_error" : <only if this server could not find itself in the router table>
 	// }
 	// @method GET
 	//
@@ -44,6 +74,8 @@ const (
 
 	// Creates a stream of data for the given partition
 	// @param partition the int partition
+	// @param token resume token, export only what comes after it (ResumableShard only)
+	// @param since marker, export only the changes made since it (DeltaShard only)
 	// @method GET
 	PARTITION_EXPORT = "/__c/pt/export"
 
@@ -52,7 +84,33 @@ const (
 	// @method POST
 	// @param partition the partition to import data
 	// @param source the http address to pull data from in the form http://address:port
+	// @param resume continue an interrupted import from its last checkpoint (ResumableShard only, default true)
+	// @param since import only the changes made since this marker (DeltaShard only)
+	// @param compression ask the source to compress the transfer, gzip or snappy
+	// @param rate max bytes per second to read from the source, 0 is unlimited
+	// Sends continue responses with "progress" (see TransferProgress) and "checkpoint" while importing
 	PARTITION_IMPORT = "/__c/pt/import"
+
+	// Returns the checksum of the data in a partition (ChecksumShard only)
+	// response format
+	// {
+	//  "strest" :{...}
+	//  "checksum" : {"count" : <number of records>, "digest" : <shard specific digest>}
+	// }
+	// @method GET
+	// @param partition
+	PARTITION_CHECKSUM = "/__c/pt/checksum"
+
+	// Returns a marker for the current state of a partition, to later
+	// export only the changes made since (DeltaShard only)
+	// response format
+	// {
+	//  "strest" :{...}
+	//  "marker" : <shard specific marker>
+	// }
+	// @method GET
+	// @param partition
+	PARTITION_MARKER = "/__c/pt/marker"
 )
 
 //These are the required return error codes for various situations
@@ -70,6 +128,13 @@ const (
 
 	// The requested partition does not live on this shard
 	E_NOT_MY_PARTITION = 635
+
+	// This shard's state does not accept the request (ie a write to a draining shard)
+	// requester should use another entry
+	E_ENTRY_STATE = 636
+
+	// This shard does not implement an optional capability (ie checksums)
+	E_NOT_SUPPORTED = 637
 )
 
 // Param Names
@@ -2,9 +2,14 @@ package shards
 
 import (
 	"fmt"
+	"github.com/trendrr/goshire-shards/shards/codec"
 	"github.com/trendrr/goshire/cheshire"
+	"github.com/trendrr/goshire/dynmap"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 )
 
@@ -26,10 +31,15 @@ func RegisterServiceControllers(man *Manager) {
 	cheshire.RegisterApi(ROUTERTABLE_SET, "POST", SetRouterTable)
 	cheshire.RegisterApi(PARTITION_LOCK, "POST", Lock)
 	cheshire.RegisterApi(PARTITION_UNLOCK, "POST", Unlock)
+	cheshire.RegisterApi(PARTITION_LOCKS, "GET", Locks)
+	cheshire.RegisterApi(PARTITION_LOCKS, "DELETE", LocksRelease)
 	cheshire.RegisterApi(CHECKIN, "GET", Checkin)
 	cheshire.RegisterApi(PARTITION_IMPORT, "POST", PartitionImport)
 	cheshire.RegisterApi(PARTITION_EXPORT, "GET", PartitionExport)
 	cheshire.RegisterApi(PARTITION_DELETE, "DELETE", PartitionDelete)
+	cheshire.RegisterApi(PARTITION_CHECKSUM, "GET", PartitionChecksum)
+	cheshire.RegisterApi(PARTITION_MARKER, "GET", PartitionMarker)
+	cheshire.RegisterApi(PARTITION_SPLIT, "POST", PartitionSplit)
 }
 
 func Checkin(txn *cheshire.Txn) {
@@ -41,6 +51,13 @@ func Checkin(txn *cheshire.Txn) {
 	}
 	response := cheshire.NewResponse(txn)
 	response.Put("rt_revision", revision)
+	response.Put("node_id", SM().MyEntryId)
+	entryId, err := SM().Identity()
+	if err != nil {
+		response.Put("identity_error", err.Error())
+	} else {
+		response.Put("entry_id", entryId)
+	}
 	response.Put("ts", time.Now())
 	txn.Write(response)
 }
@@ -88,13 +105,21 @@ func Lock(txn *cheshire.Txn) {
 		return
 	}
 
-	err := SM().LockPartition(partition)
+	owner, ok := txn.Params().GetString("owner")
+	if !ok {
+		cheshire.SendError(txn, 406, fmt.Sprintf("owner param missing"))
+		return
+	}
+	ttl := time.Duration(txn.Params().MustInt("ttl", 0)) * time.Second
+
+	lock, err := SM().LockPartition(partition, owner, ttl)
 	if err != nil {
 		//now send back an error
-		cheshire.SendError(txn, 406, fmt.Sprintf("Unable to lock partitions (%s)", err))
+		cheshire.SendError(txn, E_PARTITION_LOCKED, fmt.Sprintf("Unable to lock partitions (%s)", err))
 		return
 	}
 	response := cheshire.NewResponse(txn)
+	response.Put("lock", lock.ToDynMap())
 	txn.Write(response)
 }
 
@@ -105,7 +130,13 @@ func Unlock(txn *cheshire.Txn) {
 		return
 	}
 
-	err := SM().UnlockPartition(partition)
+	token, ok := txn.Params().GetInt64("token")
+	if !ok {
+		cheshire.SendError(txn, 406, fmt.Sprintf("token param missing"))
+		return
+	}
+
+	err := SM().UnlockPartition(partition, token)
 	if err != nil {
 		//now send back an error
 		cheshire.SendError(txn, 406, fmt.Sprintf("Unable to lock partitions (%s)", err))
@@ -115,6 +146,32 @@ func Unlock(txn *cheshire.Txn) {
 	txn.Write(response)
 }
 
+// Lists the current partition locks
+func Locks(txn *cheshire.Txn) {
+	locks := make([]*dynmap.DynMap, 0)
+	for _, l := range SM().Locks() {
+		locks = append(locks, l.ToDynMap())
+	}
+	response := cheshire.NewResponse(txn)
+	response.Put("locks", locks)
+	txn.Write(response)
+}
+
+// Force releases a partition lock
+func LocksRelease(txn *cheshire.Txn) {
+	partition, ok := txn.Params().GetInt("partition")
+	if !ok {
+		cheshire.SendError(txn, 406, fmt.Sprintf("partition param missing"))
+		return
+	}
+	err := SM().ForceUnlockPartition(partition)
+	if err != nil {
+		cheshire.SendError(txn, 406, fmt.Sprintf("Unable to release lock (%s)", err))
+		return
+	}
+	cheshire.SendSuccess(txn)
+}
+
 func PartitionDelete(txn *cheshire.Txn) {
 	log.Println("Partition DELETE!")
 	partition, ok := txn.Params().GetInt("partition")
@@ -122,6 +179,20 @@ func PartitionDelete(txn *cheshire.Txn) {
 		cheshire.SendError(txn, 406, fmt.Sprintf("partition param is manditory"))
 		return
 	}
+	if token, ok := txn.Params().GetInt64("lock_token"); ok {
+		err := SM().CheckLockToken(partition, token)
+		if err != nil {
+			cheshire.SendError(txn, E_PARTITION_LOCKED, fmt.Sprintf("Not deleting, lock is not held (%s)", err))
+			return
+		}
+	}
+	if revision, ok := txn.Params().GetInt64(P_REVISION); ok {
+		err := SM().CheckDeletable(partition, revision)
+		if err != nil {
+			cheshire.SendError(txn, 409, fmt.Sprintf("Not deleting (%s)", err))
+			return
+		}
+	}
 	log.Println("DELETE")
 	err := SM().shard.DeletePartition(partition)
 	log.Println("END DELETE")
@@ -133,6 +204,77 @@ func PartitionDelete(txn *cheshire.Txn) {
 	}
 }
 
+// Returns the checksum of the partition data
+// Requires params:
+// partition => the partition to checksum
+func PartitionChecksum(txn *cheshire.Txn) {
+	partition, ok := txn.Params().GetInt("partition")
+	if !ok {
+		cheshire.SendError(txn, 406, fmt.Sprintf("partition param is manditory"))
+		return
+	}
+	checksummer, ok := SM().shard.(ChecksumShard)
+	if !ok {
+		cheshire.SendError(txn, E_NOT_SUPPORTED, "Shard does not support checksums")
+		return
+	}
+	checksum, err := checksummer.PartitionChecksum(partition)
+	if err != nil {
+		cheshire.SendError(txn, 501, fmt.Sprintf("Error during checksum %s", err))
+		return
+	}
+	response := cheshire.NewResponse(txn)
+	response.Put("checksum", checksum.ToDynMap())
+	txn.Write(response)
+}
+
+// Returns a marker for the current state of the partition
+// Requires params:
+// partition => the partition
+func PartitionMarker(txn *cheshire.Txn) {
+	partition, ok := txn.Params().GetInt("partition")
+	if !ok {
+		cheshire.SendError(txn, 406, fmt.Sprintf("partition param is manditory"))
+		return
+	}
+	delta, ok := SM().shard.(DeltaShard)
+	if !ok {
+		cheshire.SendError(txn, E_NOT_SUPPORTED, "Shard does not support exporting changes")
+		return
+	}
+	marker, err := delta.PartitionMarker(partition)
+	if err != nil {
+		cheshire.SendError(txn, 501, fmt.Sprintf("Error getting marker %s", err))
+		return
+	}
+	response := cheshire.NewResponse(txn)
+	response.Put("marker", marker)
+	txn.Write(response)
+}
+
+// Splits all of this nodes partitions and sets the new router table
+// Requires params:
+// router_table => the split router table
+func PartitionSplit(txn *cheshire.Txn) {
+	rtmap, ok := txn.Params().GetDynMap("router_table")
+	if !ok {
+		cheshire.SendError(txn, 406, "No router_table")
+		return
+	}
+
+	rt, err := ToRouterTable(rtmap)
+	if err != nil {
+		cheshire.SendError(txn, 406, fmt.Sprintf("Unparsable router table (%s)", err))
+		return
+	}
+	err = SM().SplitPartitions(rt)
+	if err != nil {
+		cheshire.SendError(txn, 501, fmt.Sprintf("Error during split %s", err))
+		return
+	}
+	cheshire.SendSuccess(txn)
+}
+
 func PartitionExport(txn *cheshire.Txn) {
 	// make sure this is an http request.
 	hw, ok := txn.Writer.(*cheshire.HttpWriter)
@@ -140,7 +282,6 @@ func PartitionExport(txn *cheshire.Txn) {
 		cheshire.SendError(txn, 406, fmt.Sprintf("Partition Export is only available as an http request"))
 		return
 	}
-	writer := hw.Writer
 
 	partition, ok := txn.Params().GetInt("partition")
 	if !ok {
@@ -148,10 +289,60 @@ func PartitionExport(txn *cheshire.Txn) {
 		return
 	}
 
+	since, changes := txn.Params().GetString("since")
+	token, resume := txn.Params().GetString("token")
+
+	//check what the shard supports before anything is written
+	var export func(writer io.Writer, finished chan int64, errorChan chan error)
+	if changes {
+		delta, ok := SM().shard.(DeltaShard)
+		if !ok {
+			cheshire.SendError(txn, E_NOT_SUPPORTED, fmt.Sprintf("Shard does not support exporting changes"))
+			return
+		}
+		log.Printf("Exporting changes to partition %d since %s", partition, since)
+		export = func(writer io.Writer, finished chan int64, errorChan chan error) {
+			delta.ExportPartitionChanges(partition, since, writer, finished, errorChan)
+		}
+	} else if resume {
+		resumable, ok := SM().shard.(ResumableShard)
+		if !ok {
+			cheshire.SendError(txn, E_NOT_SUPPORTED, fmt.Sprintf("Shard does not support resuming exports"))
+			return
+		}
+		log.Printf("Resuming export of partition %d from %s", partition, token)
+		export = func(writer io.Writer, finished chan int64, errorChan chan error) {
+			resumable.ExportPartitionFrom(partition, token, writer, finished, errorChan)
+		}
+	} else {
+		//lets the importer report progress, sizes are before compression
+		if sizer, ok := SM().shard.(PartitionSizer); ok {
+			size, records, err := sizer.PartitionSize(partition)
+			if err == nil {
+				hw.Writer.Header().Set(HEADER_PARTITION_SIZE, strconv.FormatInt(size, 10))
+				hw.Writer.Header().Set(HEADER_PARTITION_RECORDS, strconv.FormatInt(records, 10))
+			}
+		}
+		export = func(writer io.Writer, finished chan int64, errorChan chan error) {
+			SM().shard.ExportPartition(partition, writer, finished, errorChan)
+		}
+	}
+
+	compression := NegotiateCompression(hw.Request.Header.Get("Accept-Encoding"))
+	writer, err := CompressWriter(hw.Writer, compression)
+	if err != nil {
+		cheshire.SendError(txn, 406, fmt.Sprintf("%s", err))
+		return
+	}
+	if compression != COMPRESSION_NONE {
+		hw.Writer.Header().Set("Content-Encoding", compression)
+	}
+	//flushes the compressor, once the shard is done writing
+	defer writer.Close()
+
 	finishedChan := make(chan int64)
 	errorChan := make(chan error)
-
-	go SM().shard.ExportPartition(partition, writer, finishedChan, errorChan)
+	go export(writer, finishedChan, errorChan)
 	select {
 	case bytes := <-finishedChan:
 		log.Println("Successfully exported %d bytes for partition %d", bytes, partition)
@@ -163,12 +354,18 @@ func PartitionExport(txn *cheshire.Txn) {
 }
 
 // Requests that this shard import a partition from the given source
-// Controller will issue the import request.  Will send back the
-// total number of bytes imported, and will close the txn once the data completes or an
+// Controller will issue the import request.  Sends a "progress" update every
+// PROGRESS_INTERVAL, then the total number of bytes imported, and will close the txn once the data completes or an
 // error is thrown
 // Requires params:
 // partition => The partition to import
 // source => the http address to import from.  in the form http://address:port
+// Optional params:
+// resume => if the shard is a ResumableShard, continue from the last checkpoint
+// of an earlier import from the same source (default true).  false starts over.
+// since => import only the changes made since this marker (DeltaShard only).
+// compression => ask the source to compress the transfer, gzip or snappy.
+// rate => max bytes per second to read from the source, 0 (the default) is unlimited.
 func PartitionImport(txn *cheshire.Txn) {
 	partition, ok := txn.Params().GetInt("partition")
 	if !ok {
@@ -183,34 +380,136 @@ func PartitionImport(txn *cheshire.Txn) {
 		return
 	}
 
+	since, changes := txn.Params().GetString("since")
+	delta, isDelta := SM().shard.(DeltaShard)
+	if changes && !isDelta {
+		cheshire.SendError(txn, E_NOT_SUPPORTED, "Shard does not support importing changes")
+		return
+	}
+
+	resumable, isResumable := SM().shard.(ResumableShard)
+	token := ""
+	if isResumable && !changes {
+		checkpoint, ok := SM().Checkpoint(partition, source)
+		if ok && txn.Params().MustBool("resume", true) {
+			token = checkpoint.Token
+		} else {
+			SM().ClearCheckpoint(partition)
+		}
+	}
+
 	//issue the import request..
 	address := fmt.Sprintf("%s%s?partition=%d", source, PARTITION_EXPORT, partition)
-	log.Println("Attempting to import partition %d from %s", partition, address)
+	if changes {
+		address = fmt.Sprintf("%s&since=%s", address, url.QueryEscape(since))
+	} else if len(token) > 0 {
+		address = fmt.Sprintf("%s&token=%s", address, url.QueryEscape(token))
+	}
+	log.Printf("Attempting to import partition %d from %s", partition, address)
 
-	resp, err := http.Get(address)
+	compression := txn.Params().MustString("compression", COMPRESSION_NONE)
+	if !ValidCompression(compression) {
+		cheshire.SendError(txn, 406, fmt.Sprintf("Unknown compression %s", compression))
+		return
+	}
+	request, err := http.NewRequest("GET", address, nil)
+	if err != nil {
+		cheshire.SendError(txn, 406, fmt.Sprintf("Bad source %s (%s)", source, err))
+		return
+	}
+	if compression != COMPRESSION_NONE {
+		//setting this ourselves also stops the http client from decompressing for us
+		request.Header.Set("Accept-Encoding", compression)
+	}
+
+	resp, err := http.DefaultClient.Do(request)
 	if err != nil {
 		// handle error
+		cheshire.SendError(txn, 501, fmt.Sprintf("Unable to contact %s (%s)", source, err))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
 		cheshire.SendError(txn, resp.StatusCode, resp.Status)
 		return
 	}
 
+	//the source may not support the compression we asked for
+	decompressed, err := DecompressReader(
+		NewThrottledReader(resp.Body, txn.Params().MustInt64("rate", 0)),
+		resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		cheshire.SendError(txn, 501, fmt.Sprintf("Unable to read from %s (%s)", source, err))
+		return
+	}
+	//progress is counted after decompression, to match the sizes the source reports
+	counter := NewCountingReader(decompressed)
+	//counts the records if the source sends a codec record stream
+	body := codec.NewCounter(counter)
+	totalBytes, totalRecords := partitionSizeHeaders(
+		resp.Header.Get(HEADER_PARTITION_SIZE),
+		resp.Header.Get(HEADER_PARTITION_RECORDS))
+	started := time.Now()
+	progress := func() *TransferProgress {
+		records, ok := body.Records()
+		if !ok {
+			records = -1
+		}
+		return NewTransferProgress(SM().ServiceName, partition, counter.Count(), records, totalBytes, totalRecords, time.Since(started))
+	}
+	ticker := time.NewTicker(PROGRESS_INTERVAL)
+	defer ticker.Stop()
+
 	finishedChan := make(chan int64)
 	errorChan := make(chan error)
+	checkpoints := make(chan string)
 
-	defer resp.Body.Close()
-
-	go SM().shard.ImportPartition(partition, resp.Body, finishedChan, errorChan)
-	select {
-	case bytes := <-finishedChan:
-		log.Println("Successfully imported %d bytes for partition %d", bytes, partition)
-		response := cheshire.NewResponse(txn)
-		response.Put("bytes", bytes)
-		response.SetTxnComplete()
-
-		txn.Write(response)
-	case err := <-errorChan:
-		str := fmt.Sprintf("ERROR importing bytes for partition %d -- %s", partition, err)
-		cheshire.SendError(txn, 501, str)
+	if changes {
+		go delta.ImportPartitionChanges(partition, body, finishedChan, errorChan)
+	} else if isResumable {
+		go resumable.ImportPartitionFrom(partition, token, body, checkpoints, finishedChan, errorChan)
+	} else {
+		go SM().shard.ImportPartition(partition, body, finishedChan, errorChan)
 	}
+	for {
+		select {
+		case checkpoint := <-checkpoints:
+			err := SM().SaveCheckpoint(&Checkpoint{
+				Partition: partition,
+				Source:    source,
+				Token:     checkpoint,
+			})
+			if err != nil {
+				log.Printf("ERROR saving checkpoint for partition %d -- %s", partition, err)
+			}
+			response := cheshire.NewResponse(txn)
+			response.SetTxnStatus("continue")
+			response.Put("checkpoint", checkpoint)
+			txn.Write(response)
+		case <-ticker.C:
+			p := progress()
+			log.Printf("Importing partition %d... %s", partition, p)
+			response := cheshire.NewResponse(txn)
+			response.SetTxnStatus("continue")
+			response.Put("progress", p.ToDynMap())
+			txn.Write(response)
+		case bytes := <-finishedChan:
+			log.Printf("Successfully imported %d bytes for partition %d", bytes, partition)
+			if !changes {
+				SM().ClearCheckpoint(partition)
+			}
+			response := cheshire.NewResponse(txn)
+			response.Put("bytes", bytes)
+			response.Put("resumed", len(token) > 0)
+			response.Put("progress", progress().ToDynMap())
+			response.SetTxnComplete()
 
+			txn.Write(response)
+			return
+		case err := <-errorChan:
+			str := fmt.Sprintf("ERROR importing bytes for partition %d -- %s", partition, err)
+			cheshire.SendError(txn, 501, str)
+			return
+		}
+	}
 }
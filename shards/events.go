@@ -0,0 +1,128 @@
+package shards
+
+import (
+	"log"
+	"sort"
+)
+
+type EventType string
+
+const (
+	// This node became responsible for a partition (master, replica or migration target)
+	EVENT_PARTITION_ACQUIRED EventType = "partition_acquired"
+
+	// This node is no longer responsible for a partition
+	EVENT_PARTITION_RELEASED EventType = "partition_released"
+
+	// A partition lease was taken on this node
+	EVENT_PARTITION_LOCKED EventType = "partition_locked"
+
+	// A partition lease was released on this node.
+	// leases that expire on their own are not reported.
+	EVENT_PARTITION_UNLOCKED EventType = "partition_unlocked"
+
+	// The router table changed
+	EVENT_ROUTER_TABLE_CHANGED EventType = "router_table_changed"
+)
+
+type Event struct {
+	EventType EventType
+	//the partition for partition events
+	Partition int
+	//the tables for router table events.  Old is nil for the first table
+	Old *RouterTable
+	New *RouterTable
+}
+
+// Optional interface a Shard can implement to be told when this node's
+// responsibilities change, ie to warm caches or close file handles.
+// Callbacks are made synchronously, after the change has taken effect,
+// and never while the manager holds its lock.
+type ShardListener interface {
+	PartitionAcquired(partition int)
+	PartitionReleased(partition int)
+	PartitionLocked(partition int)
+	PartitionUnlocked(partition int)
+	RouterTableChanged(old, new *RouterTable)
+}
+
+// sends the event to the shard, if it is listening.
+// caller should not hold the lock
+func (this *Manager) notify(event Event) {
+	listener, ok := this.shard.(ShardListener)
+	if !ok {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("ERROR Shard panicked handling %s event -- %s", event.EventType, r)
+		}
+	}()
+	switch event.EventType {
+	case EVENT_PARTITION_ACQUIRED:
+		listener.PartitionAcquired(event.Partition)
+	case EVENT_PARTITION_RELEASED:
+		listener.PartitionReleased(event.Partition)
+	case EVENT_PARTITION_LOCKED:
+		listener.PartitionLocked(event.Partition)
+	case EVENT_PARTITION_UNLOCKED:
+		listener.PartitionUnlocked(event.Partition)
+	case EVENT_ROUTER_TABLE_CHANGED:
+		listener.RouterTableChanged(event.Old, event.New)
+	}
+}
+
+// Sends the events for a router table change.  The table change first, then a
+// released event for every partition we lost, then an acquired event for every
+// partition we gained.
+func (this *Manager) notifyRouterTable(old, table *RouterTable) {
+	if _, ok := this.shard.(ShardListener); !ok {
+		return
+	}
+	this.notify(Event{EventType: EVENT_ROUTER_TABLE_CHANGED, Old: old, New: table})
+
+	before := this.responsibilities(old)
+	after := this.responsibilities(table)
+	for _, p := range sortedPartitions(before) {
+		if !after[p] {
+			this.notify(Event{EventType: EVENT_PARTITION_RELEASED, Partition: p})
+		}
+	}
+	for _, p := range sortedPartitions(after) {
+		if !before[p] {
+			this.notify(Event{EventType: EVENT_PARTITION_ACQUIRED, Partition: p})
+		}
+	}
+}
+
+// The partitions this node is responsible for in the table (master, replica or migration target)
+func (this *Manager) responsibilities(table *RouterTable) map[int]bool {
+	partitions := make(map[int]bool)
+	if table == nil {
+		return partitions
+	}
+	this.lock.RLock()
+	entry, ok := this.findMyEntry(table)
+	this.lock.RUnlock()
+	if !ok {
+		return partitions
+	}
+	for p, _ := range entry.PartitionsMap {
+		partitions[p] = true
+	}
+	for _, m := range table.MigrationList() {
+		if m.To == entry.Id() {
+			partitions[m.Partition] = true
+		}
+	}
+	return partitions
+}
+
+func sortedPartitions(partitions map[int]bool) []int {
+	sorted := make([]int, 0, len(partitions))
+	for p, _ := range partitions {
+		sorted = append(sorted, p)
+	}
+	sort.Ints(sorted)
+	return sorted
+}
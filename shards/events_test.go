@@ -0,0 +1,134 @@
+package shards
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type listenerShard struct {
+	DummyShard
+	events []string
+}
+
+func (this *listenerShard) PartitionAcquired(partition int) {
+	this.events = append(this.events, fmt.Sprintf("acquired %d", partition))
+}
+
+func (this *listenerShard) PartitionReleased(partition int) {
+	this.events = append(this.events, fmt.Sprintf("released %d", partition))
+}
+
+func (this *listenerShard) PartitionLocked(partition int) {
+	this.events = append(this.events, fmt.Sprintf("locked %d", partition))
+}
+
+func (this *listenerShard) PartitionUnlocked(partition int) {
+	this.events = append(this.events, fmt.Sprintf("unlocked %d", partition))
+}
+
+func (this *listenerShard) RouterTableChanged(old, table *RouterTable) {
+	this.events = append(this.events, "changed")
+}
+
+func TestShardListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shards-events")
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	shard := &listenerShard{}
+	manager := NewManager(shard, "testdb", dir, "localhost:8009")
+
+	table := func(mine, theirs []int) *RouterTable {
+		rt := NewRouterTable("testdb")
+		rt.Revision = NextRevision(0)
+		rt.Entries = []*RouterEntry{
+			&RouterEntry{Address: "localhost", JsonPort: 8009, HttpPort: 8010, BinPort: 8011, Partitions: mine},
+			&RouterEntry{Address: "other", JsonPort: 8009, HttpPort: 8010, BinPort: 8011, Partitions: theirs},
+		}
+		rt, err := rt.Rebuild()
+		if err != nil {
+			t.Fatalf("Error %s", err)
+		}
+		return rt
+	}
+
+	_, err = manager.SetRouterTable(table([]int{0, 1}, []int{2, 3}))
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	_, err = manager.SetRouterTable(table([]int{1, 2}, []int{0, 3}))
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	l, err := manager.LockPartition(1, "admin", time.Minute)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	//renewing is not a new lock
+	manager.LockPartition(1, "admin", time.Minute)
+	manager.UnlockPartition(1, l.Token)
+
+	expected := []string{
+		"changed", "acquired 0", "acquired 1",
+		"changed", "released 0", "acquired 2",
+		"locked 1", "unlocked 1",
+	}
+	if !reflect.DeepEqual(shard.events, expected) {
+		t.Errorf("Expected events %v, got %v", expected, shard.events)
+	}
+}
+
+func TestResponsibilities(t *testing.T) {
+	//the entries for a node with the given id
+	tables := map[string]func(nodeId string) []*RouterEntry{
+		"by address": func(nodeId string) []*RouterEntry {
+			return []*RouterEntry{
+				&RouterEntry{Address: "localhost", JsonPort: 8009, HttpPort: 8010, BinPort: 8011, Partitions: []int{0, 1}},
+				&RouterEntry{Address: "other", JsonPort: 8009, HttpPort: 8010, BinPort: 8011, Partitions: []int{2, 3}},
+			}
+		},
+		"by node id": func(nodeId string) []*RouterEntry {
+			return []*RouterEntry{
+				&RouterEntry{NodeId: "someone-else", Address: "localhost", JsonPort: 8009, HttpPort: 8010, BinPort: 8011, Partitions: []int{0, 1}},
+				&RouterEntry{NodeId: nodeId, Address: "10.0.0.5", JsonPort: 8009, HttpPort: 8010, BinPort: 8011, Partitions: []int{2, 3}},
+			}
+		},
+	}
+	for name, entries := range tables {
+		dir, err := ioutil.TempDir("", "shards-events")
+		if err != nil {
+			t.Fatalf("Error %s", err)
+		}
+		defer os.RemoveAll(dir)
+		manager := NewManager(&DummyShard{}, "testdb", dir, "localhost:8009")
+
+		rt := NewRouterTable("testdb")
+		rt.Revision = NextRevision(0)
+		rt.Entries = entries(manager.MyEntryId)
+		rt, err = rt.Rebuild()
+		if err != nil {
+			t.Fatalf("Error %s", err)
+		}
+		_, err = manager.SetRouterTable(rt)
+		if err != nil {
+			t.Fatalf("Error %s", err)
+		}
+		//the events must agree with what requests are accepted for
+		responsible := manager.responsibilities(rt)
+		if len(responsible) == 0 {
+			t.Errorf("%s: expected to find our entry", name)
+		}
+		for p := 0; p < rt.TotalPartitions; p++ {
+			mine, _ := manager.MyResponsibility(p)
+			if mine != responsible[p] {
+				t.Errorf("%s: partition %d, MyResponsibility is %t, responsibilities has %t", name, p, mine, responsible[p])
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package shards
+
+import (
+	"log"
+	"math/rand"
+	"time"
+)
+
+// Starts the background anti-entropy loop.
+// Every interval we checkin with a few random peers from our router table, pulling their
+// table if it is newer or pushing ours if it is older (see RouterTableSync).
+// This spreads router tables between nodes without the admin running.
+// Calling again restarts the loop with the new settings.
+func (this *Manager) StartGossip(interval time.Duration, peers int) {
+	this.StopGossip()
+	if interval <= 0 || peers <= 0 {
+		return
+	}
+	stop := make(chan bool)
+	this.lock.Lock()
+	this.gossipStop = stop
+	this.lock.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				this.Gossip(peers)
+			}
+		}
+	}()
+}
+
+// Stops the background anti-entropy loop, if it is running.
+func (this *Manager) StopGossip() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.gossipStop != nil {
+		close(this.gossipStop)
+		this.gossipStop = nil
+	}
+}
+
+// Does a single round of anti-entropy with up to peers random entries.
+// returns true if our table or any of theirs was updated.
+func (this *Manager) Gossip(peers int) bool {
+	rt, err := this.RouterTable()
+	if err != nil {
+		return false
+	}
+	id, _ := this.Identity()
+
+	candidates := make([]*RouterEntry, 0)
+	for _, e := range rt.Entries {
+		if e.Id() == id || e.EntryState() == ENTRY_DOWN {
+			continue
+		}
+		candidates = append(candidates, e)
+	}
+
+	updated := false
+	for i, p := range rand.Perm(len(candidates)) {
+		if i >= peers {
+			break
+		}
+		entry := candidates[p]
+		table, local, remote, err := RouterTableSync(rt, entry)
+		if err != nil {
+			log.Printf("Gossip with %s failed -- %s", entry.Id(), err)
+			continue
+		}
+		if local && table.TotalPartitions != rt.TotalPartitions {
+			//the partitions were split, the admin has to split ours before we can use it
+			log.Printf("Gossip skipping router table revision %d from %s, it has %d partitions and we have %d",
+				table.Revision, entry.Id(), table.TotalPartitions, rt.TotalPartitions)
+			continue
+		}
+		if local {
+			_, err = this.SetRouterTable(table)
+			if err != nil {
+				log.Printf("Gossip got an unusable router table from %s -- %s", entry.Id(), err)
+				continue
+			}
+			log.Printf("Gossip updated router table to revision %d from %s", table.Revision, entry.Id())
+			rt = table
+			updated = true
+		}
+		if remote {
+			log.Printf("Gossip pushed router table revision %d to %s", rt.Revision, entry.Id())
+			updated = true
+		}
+	}
+	return updated
+}
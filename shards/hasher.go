@@ -0,0 +1,206 @@
+package shards
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+)
+
+// The available hash algorithms.  The algorithm is recorded in the
+// router table so every proxy and service partitions the same way.
+const (
+	//md5, using the last 4 bytes. This is the original algorithm, and
+	//the default for tables that dont specify one
+	HASH_MD5_LEGACY = "md5-legacy"
+
+	//32 bit murmur3 (x86), seed 0
+	HASH_MURMUR3 = "murmur3"
+
+	//64 bit xxhash, seed 0
+	HASH_XXHASH = "xxhash"
+
+	//64 bit fnv-1a
+	HASH_FNV = "fnv"
+)
+
+// This hashes a the input string into an int between 0 (inclusive) and max (exclusive)
+type Hasher interface {
+	Hash(input string, max int) (int, error)
+}
+
+// Returns the hasher for the named algorithm.
+// returns an error if the algorithm is unknown
+func NewHasher(algorithm string) (Hasher, error) {
+	switch algorithm {
+	case HASH_MD5_LEGACY:
+		return &DefaultHasher{}, nil
+	case HASH_MURMUR3:
+		return &Murmur3Hasher{}, nil
+	case HASH_XXHASH:
+		return &XXHasher{}, nil
+	case HASH_FNV:
+		return &FnvHasher{}, nil
+	}
+	return nil, fmt.Errorf("Unknown hash algorithm: %s", algorithm)
+}
+
+// The default hasher.  md5 the input and use the last 4 bytes.
+type DefaultHasher struct {
+}
+
+func (this *DefaultHasher) Hash(input string, max int) (int, error) {
+	h := md5.New()
+	io.WriteString(h, input)
+	bytes := h.Sum(nil)
+	var hashvalue uint64 = 0
+	for i := 0; i <= 3; i++ {
+		b := bytes[(len(bytes) - 1 - (3 - i))]
+		hashvalue = hashvalue + (uint64(b))<<uint64((3-i)*8)
+	}
+	return int(hashvalue % uint64(max)), nil
+}
+
+type FnvHasher struct {
+}
+
+func (this *FnvHasher) Hash(input string, max int) (int, error) {
+	h := fnv.New64a()
+	io.WriteString(h, input)
+	return int(h.Sum64() % uint64(max)), nil
+}
+
+type Murmur3Hasher struct {
+}
+
+func (this *Murmur3Hasher) Hash(input string, max int) (int, error) {
+	return int(uint64(murmur3([]byte(input), 0)) % uint64(max)), nil
+}
+
+type XXHasher struct {
+}
+
+func (this *XXHasher) Hash(input string, max int) (int, error) {
+	return int(xxhash([]byte(input), 0) % uint64(max)), nil
+}
+
+func rotl32(x uint32, r uint) uint32 {
+	return (x << r) | (x >> (32 - r))
+}
+
+func rotl64(x uint64, r uint) uint64 {
+	return (x << r) | (x >> (64 - r))
+}
+
+// MurmurHash3_x86_32
+func murmur3(data []byte, seed uint32) uint32 {
+	const (
+		c1 = 0xcc9e2d51
+		c2 = 0x1b873593
+	)
+	h := seed
+	nblocks := len(data) / 4
+	for i := 0; i < nblocks; i++ {
+		k := binary.LittleEndian.Uint32(data[i*4:])
+		k *= c1
+		k = rotl32(k, 15)
+		k *= c2
+		h ^= k
+		h = rotl32(h, 13)
+		h = h*5 + 0xe6546b64
+	}
+
+	tail := data[nblocks*4:]
+	k := uint32(0)
+	switch len(tail) {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= c1
+		k = rotl32(k, 15)
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(len(data))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = rotl64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMerge(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
+
+// XXH64
+func xxhash(data []byte, seed uint64) uint64 {
+	n := len(data)
+	var h uint64
+	if n >= 32 {
+		v1 := seed + xxPrime1 + xxPrime2
+		v2 := seed + xxPrime2
+		v3 := seed
+		v4 := seed - xxPrime1
+		for len(data) >= 32 {
+			v1 = xxRound(v1, binary.LittleEndian.Uint64(data[0:]))
+			v2 = xxRound(v2, binary.LittleEndian.Uint64(data[8:]))
+			v3 = xxRound(v3, binary.LittleEndian.Uint64(data[16:]))
+			v4 = xxRound(v4, binary.LittleEndian.Uint64(data[24:]))
+			data = data[32:]
+		}
+		h = rotl64(v1, 1) + rotl64(v2, 7) + rotl64(v3, 12) + rotl64(v4, 18)
+		h = xxMerge(h, v1)
+		h = xxMerge(h, v2)
+		h = xxMerge(h, v3)
+		h = xxMerge(h, v4)
+	} else {
+		h = seed + xxPrime5
+	}
+	h += uint64(n)
+
+	for len(data) >= 8 {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(data))
+		h = rotl64(h, 27)*xxPrime1 + xxPrime4
+		data = data[8:]
+	}
+	if len(data) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(data)) * xxPrime1
+		h = rotl64(h, 23)*xxPrime2 + xxPrime3
+		data = data[4:]
+	}
+	for _, b := range data {
+		h ^= uint64(b) * xxPrime5
+		h = rotl64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
@@ -0,0 +1,73 @@
+package shards
+
+import (
+	"testing"
+)
+
+func TestHashVectors(t *testing.T) {
+	//published reference values
+	if h := murmur3([]byte(""), 0); h != 0 {
+		t.Errorf("murmur3 empty %x", h)
+	}
+	if h := murmur3([]byte("hello"), 0); h != 0x248bfa47 {
+		t.Errorf("murmur3 hello %x", h)
+	}
+	if h := murmur3([]byte("The quick brown fox jumps over the lazy dog"), 0); h != 0x2e4ff723 {
+		t.Errorf("murmur3 fox %x", h)
+	}
+	if h := xxhash([]byte(""), 0); h != 0xef46db3751d8e999 {
+		t.Errorf("xxhash empty %x", h)
+	}
+	if h := xxhash([]byte("abc"), 0); h != 0x44bc2cf5ad770999 {
+		t.Errorf("xxhash abc %x", h)
+	}
+	if h := xxhash([]byte("Nobody inspects the spammish repetition"), 0); h != 0xfbcea83c8a378bf1 {
+		t.Errorf("xxhash long %x", h)
+	}
+}
+
+func TestHashers(t *testing.T) {
+	for _, alg := range []string{HASH_MD5_LEGACY, HASH_MURMUR3, HASH_XXHASH, HASH_FNV} {
+		hasher, err := NewHasher(alg)
+		if err != nil {
+			t.Fatalf("Error %s", err)
+		}
+		for _, key := range []string{"", "a", "dustin|2013-05-01"} {
+			p, err := hasher.Hash(key, 512)
+			if err != nil {
+				t.Errorf("Error %s", err)
+			}
+			if p < 0 || p >= 512 {
+				t.Errorf("%s hashed %s out of range %d", alg, key, p)
+			}
+		}
+	}
+
+	_, err := NewHasher("sha-nope")
+	if err == nil {
+		t.Errorf("Expected error for unknown algorithm")
+	}
+}
+
+func TestTableHashAlgorithm(t *testing.T) {
+	table := NewRouterTable("testdb")
+	table.TotalPartitions = 0
+	table.HashAlgorithm = HASH_MURMUR3
+	mp := table.ToDynMap()
+
+	//missing algorithm is the legacy md5
+	delete(mp.Map, "hash_algorithm")
+	rt, err := ToRouterTable(mp)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if rt.HashAlgorithm != HASH_MD5_LEGACY {
+		t.Errorf("Expected %s got %s", HASH_MD5_LEGACY, rt.HashAlgorithm)
+	}
+
+	mp.Put("hash_algorithm", "sha-nope")
+	_, err = ToRouterTable(mp)
+	if err == nil {
+		t.Errorf("Expected error for unknown algorithm")
+	}
+}
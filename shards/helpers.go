@@ -1,10 +1,12 @@
 package shards
 
 import (
+	"crypto/rand"
 	"fmt"
 	"github.com/trendrr/goshire/cheshire"
 	"github.com/trendrr/goshire/client"
 	"log"
+	"strings"
 	"time"
 )
 
@@ -40,20 +42,43 @@ func RequestRouterTable(c client.Client) (*RouterTable, error) {
 
 // Finds the partition in the request, then
 //
+// The partition is taken from the shard request, the partition param (_p), or
+// is hashed from the shard key (see RouterTable.ShardKey)
+//
 // Checks the validity of the partition, and checks that the current node is responsible
-// Also checks whether the partition is locked.
+// Also checks whether the partition is locked, and that this nodes state accepts the request
+// If the manager has a LockQueueSize requests for a locked partition wait for the unlock, and
+// are forwarded to the new owner if the partition moved.  A queued request keeps its
+// place in the queue until it writes its final response, so they are handled in order.
+// (draining nodes only accept reads, joining nodes only writes)
+// Requests routed with a router table from before the last split are rejected
+// with E_ROUTER_TABLE_OLD, their partition numbers are for the old TotalPartitions.
+// Requests routed with a newer table then ours are rejected with E_SEND_ROUTER_TABLE,
+// the partitions may have been split and we have not split yet.
 //
 // This will send the appropriate response on error
 func PartitionParam(txn *cheshire.Txn) (int, bool) {
 	partition := 0
 
+	if !splitRevisionParam(txn) {
+		return 0, false
+	}
+
 	if txn.Request.Shard != nil && txn.Request.Shard.Partition >= 0 {
 		partition = txn.Request.Shard.Partition
+	} else if p, ok := txn.Params().GetInt(P_PARTITION); ok {
+		partition = p
 	} else {
-		p, ok := txn.Params().GetInt(P_PARTITION)
-		if !ok {
+		//build it from the partition keys
+		rt, err := SM().RouterTable()
+		if err != nil {
+			cheshire.SendError(txn, 506, fmt.Sprintf("Error: %s", err))
+			return 0, false
+		}
+		p, err := rt.PartitionParams(txn.Params())
+		if err != nil {
 			log.Println("Partition not found1")
-			cheshire.SendError(txn, 406, fmt.Sprintf("partition param (%s) is manditory", P_PARTITION))
+			cheshire.SendError(txn, 406, fmt.Sprintf("partition param (%s) is manditory, unless partition keys are supplied (%s)", P_PARTITION, err))
 			return 0, false
 		}
 		partition = p
@@ -61,6 +86,25 @@ func PartitionParam(txn *cheshire.Txn) (int, bool) {
 
 	//check the partition is my responsibility
 	ok, locked := SM().MyResponsibility(partition)
+	if locked && SM().LockQueueSize > 0 {
+		//hold the request until the partition is unlocked
+		release, err := SM().WaitUnlocked(partition)
+		if err != nil {
+			log.Println(err)
+			cheshire.SendError(txn, E_PARTITION_LOCKED, fmt.Sprintf("partition is locked (%s)", err))
+			return 0, false
+		}
+		SM().holdQueue(txn, release)
+		ok, locked = SM().MyResponsibility(partition)
+		if !ok && !locked {
+			//the partition moved while we waited, send it to the new owner
+			err = SM().Forward(txn, partition)
+			if err != nil {
+				cheshire.SendError(txn, E_NOT_MY_PARTITION, fmt.Sprintf("Partition %d moved, and forwarding failed (%s)", partition, err))
+			}
+			return 0, false
+		}
+	}
 	if locked {
 
 		log.Println("Partition locked")
@@ -75,9 +119,66 @@ func PartitionParam(txn *cheshire.Txn) (int, bool) {
 		return 0, false
 	}
 
+	//the target of a migration doesnt have all the data yet
+	if strings.ToUpper(txn.Request.Method()) == "GET" && SM().MigrationTarget(partition) {
+		str := fmt.Sprintf("Partition %d is still migrating to this entry", partition)
+		log.Println(str)
+		cheshire.SendError(txn, E_NOT_MY_PARTITION, str)
+		return 0, false
+	}
+
+	//check that our state allows this request
+	state := SM().MyState()
+	if !StateAccepts(state, txn.Request.Method()) {
+		str := fmt.Sprintf("This entry is %s, not accepting %s requests", state, txn.Request.Method())
+		log.Println(str)
+		cheshire.SendError(txn, E_ENTRY_STATE, str)
+		return 0, false
+	}
+
 	return partition, true
 }
 
+// Checks that the request was routed with a table that has the same partition numbering as ours.
+// Requests that name a partition must send the revision once the table has been split,
+// otherwise there is no telling which numbering the partition is from.
+// sends the error response and returns false if the request should be rejected
+func splitRevisionParam(txn *cheshire.Txn) bool {
+	rt, err := SM().RouterTable()
+	if err != nil {
+		return true
+	}
+	revision := int64(0)
+	if txn.Request.Shard != nil && txn.Request.Shard.Revision > int64(0) {
+		revision = txn.Request.Shard.Revision
+	} else if r, ok := txn.Params().GetInt64(P_REVISION); ok {
+		revision = r
+	}
+
+	if revision > rt.Revision {
+		cheshire.SendError(txn, E_SEND_ROUTER_TABLE, fmt.Sprintf("My Router Table (revision %d) is older then yours (revision %d)", rt.Revision, revision))
+		return false
+	}
+	if rt.SplitRevision == 0 {
+		return true
+	}
+	if revision == 0 {
+		_, hasPartition := txn.Params().GetInt(P_PARTITION)
+		hasPartition = hasPartition || (txn.Request.Shard != nil && txn.Request.Shard.Partition >= 0)
+		if !hasPartition {
+			//we find the partition ourselves
+			return true
+		}
+		cheshire.SendError(txn, E_ROUTER_TABLE_OLD, fmt.Sprintf("The partitions were split at revision %d, requests with a partition must send the router table revision (%s)", rt.SplitRevision, P_REVISION))
+		return false
+	}
+	if rt.SplitSince(revision) {
+		cheshire.SendError(txn, E_ROUTER_TABLE_OLD, fmt.Sprintf("Your Router Table (revision %d) is from before the partitions were split (revision %d), please update", revision, rt.SplitRevision))
+		return false
+	}
+	return true
+}
+
 // Will check the router revision param
 // will send appropriate response if revision doesnt match ours
 // returns paramExists, and OK
@@ -192,3 +293,15 @@ func RouterTableSync(routerTable *RouterTable, entry *RouterEntry) (*RouterTable
 		return routerTable, true, false, nil
 	}
 }
+
+// Generates a new random (version 4) uuid to identify a node.
+func NewNodeId() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
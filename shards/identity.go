@@ -0,0 +1,122 @@
+package shards
+
+import (
+	"fmt"
+	"github.com/trendrr/goshire/cheshire"
+	"github.com/trendrr/goshire/client"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Finds the entry for this node in the router table, without contacting anyone.
+// In order:
+// 1. the entry with our node id
+// 2. an entry without a node id at our address:jsonport
+// 3. the only entry without a node id on our jsonport with an address that resolves to one of the local addresses
+//
+// If none of those match, returns the entries that could still be us (no node id),
+// these can be confirmed with a checkin challenge (see ChallengeEntry)
+func FindMyEntry(table *RouterTable, nodeId, addressId string, local map[string]bool) (*RouterEntry, []*RouterEntry) {
+	candidates := make([]*RouterEntry, 0)
+	for _, e := range table.Entries {
+		if len(nodeId) > 0 && e.NodeId == nodeId {
+			return e, candidates
+		}
+	}
+
+	for _, e := range table.Entries {
+		//entries with a node id belong to other nodes
+		if len(e.NodeId) > 0 {
+			continue
+		}
+		if e.AddressId() == addressId {
+			return e, candidates
+		}
+		candidates = append(candidates, e)
+	}
+
+	port := addressPort(addressId)
+	localMatches := make([]*RouterEntry, 0)
+	for _, e := range candidates {
+		if e.JsonPort == port && isLocalAddress(e.Address, local) {
+			localMatches = append(localMatches, e)
+		}
+	}
+	if len(localMatches) == 1 {
+		return localMatches[0], candidates
+	}
+	return nil, candidates
+}
+
+// Does a checkin with the entry and checks if it reports our node id.
+// If it does, the entry is us.
+func ChallengeEntry(entry *RouterEntry, nodeId string) bool {
+	response, err := client.HttpApiCallSync(
+		fmt.Sprintf("%s:%d", entry.Address, entry.HttpPort),
+		cheshire.NewRequest(CHECKIN, "GET"),
+		5*time.Second)
+	if err != nil {
+		return false
+	}
+	return response.MustString("node_id", "") == nodeId
+}
+
+// The addresses of this machine, as strings.
+// includes the ip of every interface, the hostname and localhost
+func LocalAddresses() map[string]bool {
+	local := make(map[string]bool)
+	local["localhost"] = true
+	hostname, err := os.Hostname()
+	if err == nil {
+		local[hostname] = true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return local
+	}
+	for _, a := range addrs {
+		switch v := a.(type) {
+		case *net.IPNet:
+			local[v.IP.String()] = true
+		case *net.IPAddr:
+			local[v.IP.String()] = true
+		}
+	}
+	return local
+}
+
+// true if the address, or any ip it resolves to, is local
+func isLocalAddress(address string, local map[string]bool) bool {
+	if local[address] {
+		return true
+	}
+	if net.ParseIP(address) != nil {
+		return false
+	}
+	ips, err := net.LookupHost(address)
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if local[ip] {
+			return true
+		}
+	}
+	return false
+}
+
+// the port from address:port, or 0
+func addressPort(addressId string) int {
+	i := strings.LastIndex(addressId, ":")
+	if i < 0 {
+		return 0
+	}
+	port, err := strconv.Atoi(addressId[i+1:])
+	if err != nil {
+		return 0
+	}
+	return port
+}
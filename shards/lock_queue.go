@@ -0,0 +1,198 @@
+package shards
+
+import (
+	"fmt"
+	"github.com/trendrr/goshire/cheshire"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The default time a request waits for a locked partition
+const DEFAULT_LOCK_QUEUE_TIMEOUT = 30 * time.Second
+
+// Waits for the partition to be unlocked.
+// Waiters are released one at a time, in the order they arrived.  A released waiter
+// keeps its place at the head of the queue until it calls the returned release func,
+// so the next waiter is not woken until the previous request has been handled.
+// returns an error if the queue for the partition is full (see Manager.LockQueueSize)
+// or the partition is still locked after LockQueueTimeout.
+func (this *Manager) WaitUnlocked(partition int) (func(), error) {
+	this.queueLock.Lock()
+	if len(this.queues[partition]) >= this.LockQueueSize {
+		this.queueLock.Unlock()
+		return nil, fmt.Errorf("Partition %d is locked and the queue is full (%d)", partition, this.LockQueueSize)
+	}
+	waiter := make(chan bool, 1)
+	this.queues[partition] = append(this.queues[partition], waiter)
+	this.queueLock.Unlock()
+
+	once := sync.Once{}
+	release := func() {
+		once.Do(func() { this.removeWaiter(partition, waiter) })
+	}
+
+	timeout := this.queueTimeout()
+	deadline := time.After(timeout)
+	for {
+		if !this.locked(partition) && this.isHead(partition, waiter) {
+			return release, nil
+		}
+		select {
+		case <-waiter:
+			if !this.locked(partition) {
+				return release, nil
+			}
+		case <-time.After(250 * time.Millisecond):
+			//leases can expire without an unlock, so check again
+		case <-deadline:
+			release()
+			return nil, fmt.Errorf("Partition %d is still locked after %s", partition, timeout)
+		}
+	}
+}
+
+// the LockQueueTimeout, or the default
+func (this *Manager) queueTimeout() time.Duration {
+	if this.LockQueueTimeout <= 0 {
+		return DEFAULT_LOCK_QUEUE_TIMEOUT
+	}
+	return this.LockQueueTimeout
+}
+
+// Holds a queued requests place in the lock queue until the request
+// is complete, see WaitUnlocked
+type queuedWriter struct {
+	cheshire.Writer
+	release func()
+}
+
+func (this *queuedWriter) Write(response *cheshire.Response) (int, error) {
+	n, err := this.Writer.Write(response)
+	if response.TxnComplete() {
+		this.release()
+	}
+	return n, err
+}
+
+// Keeps the queue slot until the txn has written its final response.
+// a handler that never answers gives up the slot after LockQueueTimeout.
+func (this *Manager) holdQueue(txn *cheshire.Txn, release func()) {
+	txn.Writer = &queuedWriter{Writer: txn.Writer, release: release}
+	time.AfterFunc(this.queueTimeout(), release)
+}
+
+// Sends the request to the entries now responsible for the partition, and
+// writes the response to the txn.  Used to replay queued requests after
+// the partition moved while they were waiting.
+// Reads go to the first entry in RouterTable.ReadEntries, writes go to every entry in
+// RouterTable.WriteEntries and the response is from the first, the same as the proxies.
+func (this *Manager) Forward(txn *cheshire.Txn, partition int) error {
+	write := strings.ToUpper(txn.Request.Method()) != "GET"
+	var entries []*EntryClient
+	var err error
+	if write {
+		entries, err = this.connections.WriteEntries(partition)
+	} else {
+		entries, err = this.connections.ReadEntries(partition)
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		//down entries are never in the list, so this fails now instead of waiting on a dead entry
+		return fmt.Errorf("No entry accepting %s requests for partition %d, they are down or in the wrong state", txn.Request.Method(), partition)
+	}
+	rt, err := this.RouterTable()
+	if err != nil {
+		return err
+	}
+	if txn.Request.Shard != nil {
+		txn.Request.Shard.Revision = rt.Revision
+	}
+
+	response, err := this.forwardTo(entries[0], txn.Request)
+	if err != nil {
+		return err
+	}
+	if write {
+		for _, e := range entries[1:] {
+			_, err := this.forwardTo(e, txn.Request)
+			if err != nil {
+				log.Printf("Unable to copy the write to %s -- %s", e.Entry.Id(), err)
+			}
+		}
+	}
+	response.SetTxnId(txn.Request.TxnId())
+	_, err = txn.Write(response)
+	return err
+}
+
+// sends the request to a single entry
+func (this *Manager) forwardTo(entry *EntryClient, request *cheshire.Request) (*cheshire.Response, error) {
+	c, err := entry.Client()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to forward to %s -- %s", entry.Entry.Id(), err)
+	}
+	response, err := c.ApiCallSync(request, this.queueTimeout()+10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to forward to %s -- %s", entry.Entry.Id(), err)
+	}
+	return response, nil
+}
+
+// caller should not hold the lock
+func (this *Manager) locked(partition int) bool {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	return this.isLocked(partition)
+}
+
+// Wakes the first waiter on the partition, it will wake the next one once its request is done.
+func (this *Manager) releaseQueue(partition int) {
+	this.queueLock.Lock()
+	defer this.queueLock.Unlock()
+	this.wakeHead(partition)
+}
+
+// caller should hold the queueLock
+func (this *Manager) wakeHead(partition int) {
+	waiters := this.queues[partition]
+	if len(waiters) == 0 {
+		return
+	}
+	select {
+	case waiters[0] <- true:
+	default:
+	}
+}
+
+func (this *Manager) isHead(partition int, waiter chan bool) bool {
+	this.queueLock.Lock()
+	defer this.queueLock.Unlock()
+	waiters := this.queues[partition]
+	return len(waiters) > 0 && waiters[0] == waiter
+}
+
+// removes the waiter from the queue, and passes the wakeup on to the next
+// waiter if the partition is unlocked.  see WaitUnlocked
+func (this *Manager) removeWaiter(partition int, waiter chan bool) {
+	locked := this.locked(partition)
+	this.queueLock.Lock()
+	defer this.queueLock.Unlock()
+	waiters := this.queues[partition]
+	for i, w := range waiters {
+		if w == waiter {
+			this.queues[partition] = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(this.queues[partition]) == 0 {
+		delete(this.queues, partition)
+		return
+	}
+	if !locked {
+		this.wakeHead(partition)
+	}
+}
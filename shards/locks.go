@@ -0,0 +1,268 @@
+package shards
+
+import (
+	"fmt"
+	"github.com/trendrr/goshire/dynmap"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// The lease used when the locker doesnt ask for one
+const DEFAULT_LOCK_TTL = 5 * time.Minute
+
+// A lease on a partition.
+// The lock expires on its own, so a crashed locker cannot lock a partition forever.
+// Every new lock gets a larger token (fencing token), requests made under a lock can pass
+// the token so a locker whose lease expired cannot act on the partition.
+type PartitionLock struct {
+	Partition int
+	//who holds the lock (ie the admin address)
+	Owner   string
+	Token   int64
+	Expires time.Time
+}
+
+func (this *PartitionLock) Expired() bool {
+	return time.Now().After(this.Expires)
+}
+
+func ToPartitionLock(mp *dynmap.DynMap) (*PartitionLock, error) {
+	l := &PartitionLock{}
+	var ok bool
+	l.Partition, ok = mp.GetInt("partition")
+	if !ok {
+		return nil, fmt.Errorf("No partition in lock %s", mp)
+	}
+	l.Owner = mp.MustString("owner", "")
+	l.Token = mp.MustInt64("token", int64(0))
+	expires, ok := mp.GetInt64("expires")
+	if !ok {
+		return nil, fmt.Errorf("No expires in lock %s", mp)
+	}
+	l.Expires = time.Unix(0, expires*int64(time.Millisecond))
+	return l, nil
+}
+
+// Translate to a DynMap of the form:
+// {
+//     "partition" : 4,
+//     "owner" : "admin.example.com",
+//     "token" : 12,
+//     "expires" : 1381769181000 //millis
+//     "ttl" : 291 //seconds remaining
+// }
+func (this *PartitionLock) ToDynMap() *dynmap.DynMap {
+	mp := dynmap.NewDynMap()
+	mp.Put("partition", this.Partition)
+	mp.Put("owner", this.Owner)
+	mp.Put("token", this.Token)
+	mp.Put("expires", this.Expires.UnixNano()/int64(time.Millisecond))
+	ttl := int(this.Expires.Sub(time.Now()) / time.Second)
+	if ttl < 0 {
+		ttl = 0
+	}
+	mp.Put("ttl", ttl)
+	return mp
+}
+
+// Takes (or renews) the lease on the partition.
+// If another owner holds an unexpired lease an error is returned.
+// Renewing keeps the same token, a new lease always gets a larger token.
+func (this *Manager) LockPartition(partition int, owner string, ttl time.Duration) (*PartitionLock, error) {
+	lock, isNew, err := this.lockPartition(partition, owner, ttl)
+	if isNew {
+		this.notify(Event{EventType: EVENT_PARTITION_LOCKED, Partition: partition})
+	}
+	return lock, err
+}
+
+// returns the lock, and whether it is a new lease
+func (this *Manager) lockPartition(partition int, owner string, ttl time.Duration) (*PartitionLock, bool, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if ttl <= 0 {
+		ttl = DEFAULT_LOCK_TTL
+	}
+	l, ok := this.locks[partition]
+	if ok && !l.Expired() && l.Owner != owner {
+		return nil, false, fmt.Errorf("Partition %d is locked by %s until %s", partition, l.Owner, l.Expires)
+	}
+	isNew := !ok || l.Expired()
+	if isNew {
+		this.lockToken++
+		l = &PartitionLock{
+			Partition: partition,
+			Owner:     owner,
+			Token:     this.lockToken,
+		}
+		this.locks[partition] = l
+	}
+	l.Expires = time.Now().Add(ttl)
+	lock := *l
+	err := this.saveLocks()
+	return &lock, isNew, err
+}
+
+// Releases the lease on the partition.  The token must match the current lease.
+// Unlocking an unlocked (or expired) partition is not an error.
+func (this *Manager) UnlockPartition(partition int, token int64) error {
+	released, err := this.unlockPartition(partition, token)
+	if released {
+		this.notify(Event{EventType: EVENT_PARTITION_UNLOCKED, Partition: partition})
+	}
+	return err
+}
+
+// returns true if an active lease was released
+func (this *Manager) unlockPartition(partition int, token int64) (bool, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	l, ok := this.locks[partition]
+	if !ok || l.Expired() {
+		delete(this.locks, partition)
+		this.releaseQueue(partition)
+		return false, nil
+	}
+	if l.Token != token {
+		return false, fmt.Errorf("Partition %d is locked with token %d, not %d", partition, l.Token, token)
+	}
+	delete(this.locks, partition)
+	this.releaseQueue(partition)
+	return true, this.saveLocks()
+}
+
+// Releases the lease on the partition no matter who holds it.
+// For operators cleaning up after a crashed locker.
+func (this *Manager) ForceUnlockPartition(partition int) error {
+	this.lock.Lock()
+	l, ok := this.locks[partition]
+	if !ok {
+		this.lock.Unlock()
+		return fmt.Errorf("Partition %d is not locked", partition)
+	}
+	delete(this.locks, partition)
+	this.releaseQueue(partition)
+	log.Printf("Force released lock on partition %d held by %s (token %d)", partition, l.Owner, l.Token)
+	err := this.saveLocks()
+	this.lock.Unlock()
+
+	this.notify(Event{EventType: EVENT_PARTITION_UNLOCKED, Partition: partition})
+	return err
+}
+
+// Checks that the token is the token of the current, unexpired lease on the partition
+func (this *Manager) CheckLockToken(partition int, token int64) error {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	l, ok := this.locks[partition]
+	if !ok || l.Expired() {
+		return fmt.Errorf("Partition %d is not locked (token %d)", partition, token)
+	}
+	if l.Token != token {
+		return fmt.Errorf("Partition %d is locked with token %d, not %d", partition, l.Token, token)
+	}
+	return nil
+}
+
+// Checks that the partition can be deleted after a move, without a lock.
+// Our router table must be at least the given revision (the one the partition moved in),
+// and we must no longer be responsible for the partition.
+func (this *Manager) CheckDeletable(partition int, revision int64) error {
+	rt, err := this.RouterTable()
+	if err != nil {
+		return err
+	}
+	if rt.Revision < revision {
+		return fmt.Errorf("My router table (revision %d) is older then revision %d", rt.Revision, revision)
+	}
+	mine, _ := this.MyResponsibility(partition)
+	if mine {
+		return fmt.Errorf("Partition %d is my responsibility in router table revision %d", partition, rt.Revision)
+	}
+	return nil
+}
+
+// Returns the current, unexpired leases sorted by partition
+func (this *Manager) Locks() []*PartitionLock {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	partitions := make([]int, 0)
+	for p, l := range this.locks {
+		if !l.Expired() {
+			partitions = append(partitions, p)
+		}
+	}
+	sort.Ints(partitions)
+	locks := make([]*PartitionLock, 0)
+	for _, p := range partitions {
+		l := *this.locks[p]
+		locks = append(locks, &l)
+	}
+	return locks
+}
+
+// caller should hold the lock
+func (this *Manager) isLocked(partition int) bool {
+	l, ok := this.locks[partition]
+	return ok && !l.Expired()
+}
+
+func (this *Manager) locksFilename() string {
+	if this.DataDir == "" {
+		return fmt.Sprintf("%s.locks", this.ServiceName)
+	}
+	return fmt.Sprintf("%s%c%s.locks", this.DataDir, os.PathSeparator, this.ServiceName)
+}
+
+// loads the persisted leases.  Expired leases are dropped, but the token
+// is kept so tokens never go backwards.
+func (this *Manager) loadLocks() error {
+	bytes, err := ioutil.ReadFile(this.locksFilename())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	mp := dynmap.NewDynMap()
+	err = mp.UnmarshalJSON(bytes)
+	if err != nil {
+		return err
+	}
+	this.lockToken = mp.MustInt64("token", int64(0))
+	lockMaps, _ := mp.GetDynMapSlice("locks")
+	for _, lm := range lockMaps {
+		l, err := ToPartitionLock(lm)
+		if err != nil {
+			return err
+		}
+		if l.Token > this.lockToken {
+			this.lockToken = l.Token
+		}
+		if !l.Expired() {
+			this.locks[l.Partition] = l
+		}
+	}
+	return nil
+}
+
+// caller should hold the lock
+func (this *Manager) saveLocks() error {
+	mp := dynmap.NewDynMap()
+	mp.Put("token", this.lockToken)
+	locks := make([]*dynmap.DynMap, 0)
+	for _, l := range this.locks {
+		if !l.Expired() {
+			locks = append(locks, l.ToDynMap())
+		}
+	}
+	mp.Put("locks", locks)
+	bytes, err := mp.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	return WriteFileSafe(this.locksFilename(), bytes, 0)
+}
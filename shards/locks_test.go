@@ -0,0 +1,206 @@
+package shards
+
+import (
+	"github.com/trendrr/goshire/cheshire"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPartitionLocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shards-locks")
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	manager := NewManager(&DummyShard{}, "testdb", dir, "localhost:8009")
+	l, err := manager.LockPartition(1, "admin1", time.Minute)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if _, err := manager.LockPartition(1, "admin2", time.Minute); err == nil {
+		t.Errorf("Expected lock by another owner to fail")
+	}
+	renewed, err := manager.LockPartition(1, "admin1", time.Minute)
+	if err != nil || renewed.Token != l.Token {
+		t.Errorf("Expected renew to keep token %d, got %v (%s)", l.Token, renewed, err)
+	}
+	if _, locked := manager.MyResponsibility(1); !locked {
+		t.Errorf("Expected partition 1 to be locked")
+	}
+	if err := manager.UnlockPartition(1, l.Token+1); err == nil {
+		t.Errorf("Expected unlock with the wrong token to fail")
+	}
+
+	//the lock survives a restart
+	manager = NewManager(&DummyShard{}, "testdb", dir, "localhost:8009")
+	if err := manager.CheckLockToken(1, l.Token); err != nil {
+		t.Errorf("Expected lock to be loaded from disk (%s)", err)
+	}
+	if err := manager.UnlockPartition(1, l.Token); err != nil {
+		t.Errorf("Error %s", err)
+	}
+
+	//expired locks dont count, and new locks get a larger token
+	expiring, err := manager.LockPartition(2, "admin1", time.Millisecond)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, locked := manager.MyResponsibility(2); locked {
+		t.Errorf("Expected lock to expire")
+	}
+	next, err := manager.LockPartition(2, "admin2", time.Minute)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if next.Token <= expiring.Token {
+		t.Errorf("Expected token greater then %d, got %d", expiring.Token, next.Token)
+	}
+	if err := manager.ForceUnlockPartition(2); err != nil {
+		t.Errorf("Error %s", err)
+	}
+	if len(manager.Locks()) != 0 {
+		t.Errorf("Expected no locks, got %v", manager.Locks())
+	}
+}
+
+func TestLockQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shards-locks")
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	manager := NewManager(&DummyShard{}, "testdb", dir, "localhost:8009")
+	manager.LockQueueSize = 2
+	manager.LockQueueTimeout = 5 * time.Second
+
+	l, err := manager.LockPartition(1, "admin1", time.Minute)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+
+	released := make(chan int, 2)
+	done := make([]chan bool, 2)
+	for i := 0; i < 2; i++ {
+		done[i] = make(chan bool)
+		go func(i int) {
+			release, err := manager.WaitUnlocked(1)
+			if err != nil {
+				t.Errorf("Error %s", err)
+				return
+			}
+			released <- i
+			//handle the request
+			<-done[i]
+			release()
+		}(i)
+		//make sure they queue in order
+		time.Sleep(20 * time.Millisecond)
+	}
+	if _, err := manager.WaitUnlocked(1); err == nil {
+		t.Errorf("Expected the queue to be full")
+	}
+
+	manager.UnlockPartition(1, l.Token)
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-released:
+			if r != i {
+				t.Errorf("Expected waiter %d to be released, got %d", i, r)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Waiter %d was not released", i)
+		}
+		//the next waiter holds until this request is done
+		select {
+		case r := <-released:
+			t.Fatalf("Waiter %d was released before waiter %d finished", r, i)
+		case <-time.After(400 * time.Millisecond):
+		}
+		close(done[i])
+	}
+
+	//times out
+	manager.LockQueueTimeout = 50 * time.Millisecond
+	manager.LockPartition(1, "admin1", time.Minute)
+	if _, err := manager.WaitUnlocked(1); err == nil {
+		t.Errorf("Expected a timeout")
+	}
+}
+
+func TestForwardDownEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shards-locks")
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	manager := NewManager(&DummyShard{}, "testdb", dir, "localhost:8009")
+	rt := NewRouterTable("testdb")
+	rt.Revision = NextRevision(0)
+	rt.Entries = []*RouterEntry{
+		&RouterEntry{Address: "localhost", JsonPort: 8009, HttpPort: 8010, BinPort: 8011, Partitions: []int{0}},
+		&RouterEntry{Address: "other1", JsonPort: 8009, HttpPort: 8010, BinPort: 8011, Partitions: []int{1}, State: ENTRY_DOWN},
+	}
+	rt, err = rt.Rebuild()
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	_, err = manager.SetRouterTable(rt)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+
+	//fails right away instead of waiting on the dead entry
+	start := time.Now()
+	txn := &cheshire.Txn{Request: cheshire.NewRequest("/test", "POST")}
+	err = manager.Forward(txn, 1)
+	if err == nil {
+		t.Fatalf("Expected an error forwarding to a down entry")
+	}
+	if !strings.Contains(err.Error(), "No entry accepting") {
+		t.Errorf("Expected a clear error, got %s", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Forward took %s to fail", time.Since(start))
+	}
+}
+
+func TestCheckDeletable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shards-locks")
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	manager := NewManager(&DummyShard{}, "testdb", dir, "localhost:8009")
+	rt := NewRouterTable("testdb")
+	rt.Revision = NextRevision(0)
+	rt.Entries = []*RouterEntry{
+		&RouterEntry{Address: "localhost", JsonPort: 8009, HttpPort: 8010, BinPort: 8011, Partitions: []int{0}},
+		&RouterEntry{Address: "other1", JsonPort: 8009, HttpPort: 8010, BinPort: 8011, Partitions: []int{1}},
+	}
+	rt, err = rt.Rebuild()
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	_, err = manager.SetRouterTable(rt)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+
+	if err := manager.CheckDeletable(1, rt.Revision); err != nil {
+		t.Errorf("Expected partition 1 to be deletable, got %s", err)
+	}
+	if err := manager.CheckDeletable(0, rt.Revision); err == nil {
+		t.Errorf("Expected partition 0 not to be deletable, it is ours")
+	}
+	if err := manager.CheckDeletable(1, rt.Revision+1); err == nil {
+		t.Errorf("Expected an error when our router table is older then the move")
+	}
+}
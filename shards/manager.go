@@ -10,6 +10,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -19,6 +20,7 @@ type Shard interface {
 
 	//Exports all the data for a specific partition
 	//should send total # of bytes on the finished chanel when complete
+	//the format is up to the shard, see the codec package for a standard one.
 	ExportPartition(partition int, writer io.Writer, finished chan int64, errorChan chan error)
 
 	//Imports data
@@ -28,6 +30,14 @@ type Shard interface {
 	DeletePartition(partition int) error
 }
 
+// Optional interface a Shard can implement to allow growing the total number of partitions.
+type PartitionSplitter interface {
+	// Re-buckets the data in partition into its children.
+	// the children are partition + n*oldTotal for n in 0..(newTotal/oldTotal - 1),
+	// so data for partition p should be moved to hash(key) % newTotal
+	SplitPartition(partition, oldTotal, newTotal int) error
+}
+
 // A dummy service
 type DummyShard struct {
 }
@@ -47,10 +57,9 @@ func (this *DummyShard) DeletePartition(partition int) error {
 	return nil
 }
 
-type EventType string
-
-type Event struct {
-	EventType string
+func (this *DummyShard) SplitPartition(partition, oldTotal, newTotal int) error {
+	log.Printf("Requesting SplitPartition from dummy service, ignoring.. (partition: %d)", partition)
+	return nil
 }
 
 // Manages the router table and connections and things
@@ -59,10 +68,38 @@ type Manager struct {
 	connections *Connections
 	ServiceName string
 	DataDir     string
-	//my entry id.  TODO: need a good way to autodiscover this..
-	MyEntryId        string
-	shard            Shard
-	lockedPartitions map[int]bool
+	//my entry id.  This is the node id, generated on first start and
+	//stored in the DataDir.  see RouterEntry.NodeId
+	MyEntryId string
+	//address:jsonport of this node.  Only used to find ourselves in
+	//router tables that predate node ids
+	MyAddressId string
+	shard       Shard
+	//partition leases, see PartitionLock
+	locks map[int]*PartitionLock
+	//the last fencing token handed out
+	lockToken int64
+
+	//How many requests can wait on a single locked partition.
+	//0 (the default) means requests for locked partitions fail immediately
+	//with E_PARTITION_LOCKED.  see WaitUnlocked
+	LockQueueSize int
+	//How long a request waits for a locked partition
+	LockQueueTimeout time.Duration
+	//requests waiting on locked partitions
+	queues    map[int][]chan bool
+	queueLock sync.Mutex
+
+	//closed to stop the gossip loop, see StartGossip
+	gossipStop chan bool
+
+	//guards the import checkpoints file, see Checkpoint
+	checkpointLock sync.Mutex
+
+	//the id of our entry in the current router table, see updateIdentity
+	myId string
+	//set when we could not find ourselves in the router table
+	identityErr error
 }
 
 // Creates a new manager.  Uses the one or more seed urls to download the
@@ -71,6 +108,9 @@ func NewManagerSeed(shard Shard, serviceName, dataDir, myEntryId string, seedHtt
 	//TODO: can we get the servicename from the routing table?
 	manager := NewManager(shard, serviceName, dataDir, myEntryId)
 	err := manager.connections.InitFromSeed(seedHttpUrls...)
+	if err == nil {
+		manager.notifyRouterTable(nil, manager.connections.RouterTable())
+	}
 	//we still return the manager since it is usable just doesnt have a routing table.
 	return manager, err
 }
@@ -92,6 +132,8 @@ func NewManagerConfig(shard Shard, conf *cheshire.ServerConfig)	(*Manager, error
 	id := fmt.Sprintf("%s:%d", broadcastAddress, conf.MustInt("ports.json", 8009))
 	dataDir := conf.MustString("data_dir", "data")
 	manager := NewManager(shard, serviceName, dataDir, id)
+	manager.LockQueueSize = conf.MustInt("shards.lock_queue.size", 0)
+	manager.LockQueueTimeout = time.Duration(conf.MustInt("shards.lock_queue.timeout", 30)) * time.Second
 	rt, err := manager.RouterTable()
 	if err != nil || rt.Revision == int64(0) {
 		//set the dummy router table.
@@ -99,32 +141,60 @@ func NewManagerConfig(shard Shard, conf *cheshire.ServerConfig)	(*Manager, error
 		if err != nil {
 			return nil, err
 		}
+		rt.Entries[0].NodeId = manager.MyEntryId
+		rt, err = rt.Rebuild()
+		if err != nil {
+			return nil, err
+		}
 		manager.SetRouterTable(rt)
 	}
+	//spread router tables between nodes, 0 disables
+	manager.StartGossip(
+		time.Duration(conf.MustInt("shards.gossip.interval", 30))*time.Second,
+		conf.MustInt("shards.gossip.peers", 2))
 	return manager, nil
 }
 
 //Creates a new manager.  will load the routing table from disk if
 //it exists
+// myEntryId is the address:jsonport of this node, it is only used for router tables
+// without node ids
 func NewManager(shard Shard, serviceName, dataDir, myEntryId string) *Manager {
-	rtchange := make(chan *RouterTable)
+	//buffered so a change made while we are saving is not dropped, changes
+	//that pile up beyond that are coalesced (save always writes the latest table)
+	rtchange := make(chan *RouterTable, 1)
 
 	manager := &Manager{
 		connections:      &Connections{RouterTableChange: rtchange},
 		DataDir:          dataDir,
 		ServiceName:      serviceName,
-		MyEntryId:        myEntryId,
-		shard:            shard,
-		lockedPartitions: make(map[int]bool),
+		MyAddressId: myEntryId,
+		shard:       shard,
+		locks:       make(map[int]*PartitionLock),
+		queues:      make(map[int][]chan bool),
 	}
-	//attempt to load from disk
-	err := manager.load()
+	nodeId, err := manager.loadNodeId()
 	if err != nil {
-		log.Println(err)
+		log.Printf("ERROR Unable to load or save node id, this node will get a new id on restart (%s)", err)
+	}
+	manager.MyEntryId = nodeId
+
+	err = manager.loadLocks()
+	if err != nil {
+		log.Printf("ERROR Unable to load partition locks (%s)", err)
+	}
+
+	//attempt to load from disk
+	err = manager.load()
+	if os.IsNotExist(err) {
+		log.Printf("No router table found at %s", manager.filename())
+	} else if err != nil {
+		log.Printf("ERROR Unable to load router table from %s (%s)", manager.filename(), err)
 		// log.Println("Unable to load router table, setting dummy routertable")
 		// manager.SetRouterTable(NewRouterTable(serviceName))
 	}
 	// Save whenever the routertable is changed.
+	identityChange := make(chan bool, 1)
 	go func() {
 		for {
 			<-rtchange
@@ -132,6 +202,18 @@ func NewManager(shard Shard, serviceName, dataDir, myEntryId string) *Manager {
 			if err != nil {
 				log.Printf("ERROR Trying to save router table : %s", err)
 			}
+			//identity discovery can make http calls, so it runs separately.
+			select {
+			case identityChange <- true:
+			default:
+			}
+		}
+	}()
+	go func() {
+		manager.updateIdentity()
+		for {
+			<-identityChange
+			manager.updateIdentity()
 		}
 	}()
 	return manager
@@ -143,19 +225,134 @@ func (this *Manager) RegisterControllers() error {
 	return nil
 }
 
-// Puts a lock on the specified partition (locally only)
-func (this *Manager) LockPartition(partition int) error {
-	this.lock.Lock()
-	defer this.lock.Unlock()
-	this.lockedPartitions[partition] = true
-	return nil
+// Splits all the partitions this node holds (master or replica) and then
+// switches to the new router table.  The partitions are locked for the
+// duration of the split.
+func (this *Manager) SplitPartitions(table *RouterTable) error {
+	splitter, ok := this.shard.(PartitionSplitter)
+	if !ok {
+		return fmt.Errorf("Shard does not support splitting partitions")
+	}
+	current, err := this.RouterTable()
+	if err != nil {
+		return err
+	}
+	if table.TotalPartitions <= current.TotalPartitions || table.TotalPartitions%current.TotalPartitions != 0 {
+		return fmt.Errorf("Cannot split %d partitions into %d", current.TotalPartitions, table.TotalPartitions)
+	}
+
+	partitions := make([]int, 0)
+	this.lock.RLock()
+	e, ok := this.myEntry()
+	this.lock.RUnlock()
+	if ok {
+		for p, _ := range e.Entry.PartitionsMap {
+			partitions = append(partitions, p)
+		}
+	}
+
+	for _, p := range partitions {
+		l, err := this.LockPartition(p, "split", time.Hour)
+		if err != nil {
+			return err
+		}
+		defer this.UnlockPartition(p, l.Token)
+	}
+
+	for _, p := range partitions {
+		err = splitter.SplitPartition(p, current.TotalPartitions, table.TotalPartitions)
+		if err != nil {
+			return fmt.Errorf("Error splitting partition %d (%s)", p, err)
+		}
+	}
+	//the data is rebucketed, so we can switch to the new numbering
+	_, err = this.setRouterTable(table)
+	return err
 }
 
-func (this *Manager) UnlockPartition(partition int) error {
+// Finds the connection to this node in the router table.
+func (this *Manager) myEntry() (*EntryClient, bool) {
+	entry, ok := this.findMyEntry(this.connections.RouterTable())
+	if !ok {
+		return nil, false
+	}
+	return this.connections.EntryById(entry.Id())
+}
+
+// Finds this node in the table.
+// looks by node id, then by address for older tables, then
+// whatever updateIdentity discovered.
+// caller should hold the lock
+func (this *Manager) findMyEntry(table *RouterTable) (*RouterEntry, bool) {
+	if table == nil {
+		return nil, false
+	}
+	e, ok := table.FindEntry(this.MyEntryId)
+	if ok {
+		return e, ok
+	}
+	e, ok = table.FindEntry(this.MyAddressId)
+	if ok && len(e.NodeId) == 0 {
+		return e, ok
+	}
+	if len(this.myId) > 0 {
+		e, ok = table.FindEntry(this.myId)
+		if ok && (len(e.NodeId) == 0 || e.NodeId == this.MyEntryId) {
+			return e, ok
+		}
+	}
+	return nil, false
+}
+
+// Finds our entry in the current router table.
+// Tries node id, address and local interface addresses (see FindMyEntry), and
+// finally a checkin challenge against every entry that could be us.
+// If we are not found the error is logged and reported in the checkin.
+func (this *Manager) updateIdentity() {
+	rt, err := this.RouterTable()
+	if err != nil {
+		return
+	}
+	entry, candidates := FindMyEntry(rt, this.MyEntryId, this.MyAddressId, LocalAddresses())
+	if entry == nil {
+		for _, c := range candidates {
+			if ChallengeEntry(c, this.MyEntryId) {
+				entry = c
+				break
+			}
+		}
+	}
+
+	id := ""
+	if entry != nil {
+		id = entry.Id()
+		err = nil
+	} else {
+		err = fmt.Errorf("Unable to find this node (node id %s, address %s) in router table %s revision %d", this.MyEntryId, this.MyAddressId, rt.Service, rt.Revision)
+		log.Printf("ERROR %s. This node will not accept requests for any partition", err)
+	}
 	this.lock.Lock()
-	defer this.lock.Unlock()
-	delete(this.lockedPartitions, partition)
-	return nil
+	this.myId = id
+	this.identityErr = err
+	this.lock.Unlock()
+}
+
+// Returns the id of our entry in the router table, or an error if
+// we could not find ourselves.
+func (this *Manager) Identity() (string, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	if this.identityErr != nil {
+		return "", this.identityErr
+	}
+	if len(this.myId) > 0 {
+		return this.myId, nil
+	}
+	e, ok := this.myEntry()
+	if !ok {
+		return "", fmt.Errorf("Unable to find this node (node id %s) in the router table", this.MyEntryId)
+	}
+	return e.Entry.Id(), nil
 }
 
 // Returns the list of partitions I am responsible for
@@ -167,14 +364,31 @@ func (this *Manager) MyPartitions() []int {
 		return make([]int, 0)
 	}
 
-	e, ok := this.connections.EntryById(this.MyEntryId)
+	e, ok := this.myEntry()
 	if !ok {
 		return make([]int, 0)
 	}
 	return e.Entry.Partitions
 }
 
-// Checks if this partition is my responsibility.
+// Returns the state of this node in the router table (see the ENTRY_* constants).
+// Nodes that are not in the router table are down.
+func (this *Manager) MyState() string {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	if this.connections == nil {
+		return ENTRY_DOWN
+	}
+	e, ok := this.myEntry()
+	if !ok {
+		return ENTRY_DOWN
+	}
+	return e.Entry.EntryState()
+}
+
+// Checks if this partition is my responsibility (either as master, replica or migration target).
+// Replicas accept writes as well as reads, the proxies copy writes to every entry in
+// RouterTable.WriteEntries and each copy applies them itself.
 // This is also how we test for locked partitions.
 //
 // returns responsibility, locked
@@ -184,16 +398,39 @@ func (this *Manager) MyResponsibility(partition int) (bool, bool) {
 	defer this.lock.RUnlock()
 	isMine := false
 	if this.connections != nil {
-		e, ok := this.connections.EntryById(this.MyEntryId)
+		e, ok := this.myEntry()
 		if ok {
-			isMine, _ = e.Entry.PartitionsMap[partition]
+			_, isMine = e.Entry.PartitionsMap[partition]
+			isMine = isMine || this.isMigrationTarget(e.Entry, partition)
 		}
 	}
-	locked, ok := this.lockedPartitions[partition]
+	return isMine, this.isLocked(partition)
+}
+
+// Checks if this partition is migrating to this node.  The target of a migration
+// accepts writes for the partition, but should not serve reads until the
+// migration is finished.
+func (this *Manager) MigrationTarget(partition int) bool {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	if this.connections == nil {
+		return false
+	}
+	e, ok := this.myEntry()
 	if !ok {
-		locked = false
+		return false
 	}
-	return isMine, locked
+	return this.isMigrationTarget(e.Entry, partition)
+}
+
+// caller should hold the lock
+func (this *Manager) isMigrationTarget(entry *RouterEntry, partition int) bool {
+	table := this.connections.RouterTable()
+	if table == nil {
+		return false
+	}
+	m, ok := table.Migration(partition)
+	return ok && m.To == entry.Id()
 }
 
 //Sets the service for this manager
@@ -214,21 +451,26 @@ func (this *Manager) Checkin(client client.Client) (int64, error) {
 }
 
 //loads the stored version
+//falls back to older generations if the current file is damaged
 func (this *Manager) load() error {
-	bytes, err := ioutil.ReadFile(this.filename())
-	if err != nil {
+	var table *RouterTable
+	_, err := ReadFileSafe(this.filename(), DEFAULT_GENERATIONS, func(bytes []byte) error {
+		mp := dynmap.NewDynMap()
+		err := mp.UnmarshalJSON(bytes)
+		if err != nil {
+			return err
+		}
+		table, err = ToRouterTable(mp)
 		return err
-	}
-	mp := dynmap.NewDynMap()
-	err = mp.UnmarshalJSON(bytes)
+	})
 	if err != nil {
 		return err
 	}
-	table, err := ToRouterTable(mp)
+	_, err = this.connections.SetRouterTable(table)
 	if err != nil {
 		return err
 	}
-	this.connections.SetRouterTable(table)
+	this.notifyRouterTable(nil, table)
 	return nil
 }
 
@@ -242,8 +484,30 @@ func (this *Manager) save() error {
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(this.filename(), bytes, 0644)
-	return err
+	return WriteFileSafe(this.filename(), bytes, DEFAULT_GENERATIONS)
+}
+
+// loads the node id from the DataDir, generating and saving a new one
+// if none exists.  Will always return an id, the error is for saving.
+func (this *Manager) loadNodeId() (string, error) {
+	bytes, err := ioutil.ReadFile(this.nodeIdFilename())
+	if err == nil && len(strings.TrimSpace(string(bytes))) > 0 {
+		return strings.TrimSpace(string(bytes)), nil
+	}
+	id, err := NewNodeId()
+	if err != nil {
+		return id, err
+	}
+	log.Printf("Generated new node id %s", id)
+	err = WriteFileSafe(this.nodeIdFilename(), []byte(id), 0)
+	return id, err
+}
+
+func (this *Manager) nodeIdFilename() string {
+	if this.DataDir == "" {
+		return "node.id"
+	}
+	return fmt.Sprintf("%s%cnode.id", this.DataDir, os.PathSeparator)
 }
 
 func (this *Manager) filename() string {
@@ -277,10 +541,35 @@ func (this *Manager) RouterTable() (*RouterTable, error) {
 }
 
 // Sets a new router table, returns the old one
+// The table is validated first, a table with any errors is rejected.
+// A table with a different number of partitions is rejected, our data is bucketed
+// for the current number.  Those tables can only be set by SplitPartitions.
 func (this *Manager) SetRouterTable(rt *RouterTable) (*RouterTable, error) {
+	current, err := this.RouterTable()
+	if err == nil && current.TotalPartitions != rt.TotalPartitions {
+		return nil, fmt.Errorf("Router table revision %d has %d partitions, we have %d.  Partitions must be split first (see PARTITION_SPLIT)",
+			rt.Revision, rt.TotalPartitions, current.TotalPartitions)
+	}
+	return this.setRouterTable(rt)
+}
+
+// Sets the router table without checking the number of partitions.
+func (this *Manager) setRouterTable(rt *RouterTable) (*RouterTable, error) {
 	if rt.Service != this.ServiceName {
 		return nil, fmt.Errorf("Error cannot set router table for service %s, should be service %s", rt.Service, this.ServiceName)
 	}
+	problems := rt.Validate()
+	for _, p := range problems {
+		log.Printf("Router table %d %s", rt.Revision, p)
+	}
+	err := ProblemsError(problems)
+	if err != nil {
+		return nil, err
+	}
 	old, err := this.connections.SetRouterTable(rt)
-	return old, err
+	if err != nil {
+		return old, err
+	}
+	this.notifyRouterTable(old, rt)
+	return old, nil
 }
@@ -0,0 +1,123 @@
+package shards
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+type splitterShard struct {
+	DummyShard
+	splits int
+}
+
+func (this *splitterShard) SplitPartition(partition, oldTotal, newTotal int) error {
+	this.splits++
+	return nil
+}
+
+func TestSetRouterTableSplit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shards-split")
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	shard := &splitterShard{}
+	manager := NewManager(shard, "testdb", dir, "localhost:8009")
+
+	rt := NewRouterTable("testdb")
+	rt.Revision = NextRevision(0)
+	rt.TotalPartitions = 4
+	rt.Entries = []*RouterEntry{
+		&RouterEntry{Address: "localhost", JsonPort: 8009, HttpPort: 8010, BinPort: 8011, Partitions: []int{0, 1, 2, 3}},
+	}
+	rt, err = rt.Rebuild()
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	_, err = manager.SetRouterTable(rt)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+
+	split, err := rt.Split(2)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	//gossip or the admin can deliver the split table before we have split
+	_, err = manager.SetRouterTable(split)
+	if err == nil {
+		t.Fatalf("Expected a table with more partitions to be rejected")
+	}
+	current, _ := manager.RouterTable()
+	if current.TotalPartitions != 4 {
+		t.Errorf("Expected to still have 4 partitions, got %d", current.TotalPartitions)
+	}
+
+	//so the split can still happen
+	err = manager.SplitPartitions(split)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	current, _ = manager.RouterTable()
+	if current.TotalPartitions != 8 || shard.splits != 4 {
+		t.Errorf("Expected 4 partitions split into 8, got %d (%d splits)", current.TotalPartitions, shard.splits)
+	}
+}
+
+func TestMyResponsibilityReplicas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shards-replicas")
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	manager := NewManager(&DummyShard{}, "testdb", dir, "localhost:8009")
+
+	rt := NewRouterTable("testdb")
+	rt.Revision = NextRevision(0)
+	rt.ReplicationFactor = 2
+	rt.Entries = []*RouterEntry{
+		&RouterEntry{Address: "localhost", JsonPort: 8009, HttpPort: 8010, BinPort: 8011, Partitions: []int{0, 1}},
+		&RouterEntry{Address: "other1", JsonPort: 8009, HttpPort: 8010, BinPort: 8011, Partitions: []int{2, 3}},
+		&RouterEntry{Address: "other2", JsonPort: 8009, HttpPort: 8010, BinPort: 8011, Partitions: []int{4, 5}},
+	}
+	rt, err = rt.Rebuild()
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	_, err = manager.SetRouterTable(rt)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+
+	me, _ := rt.FindEntry("localhost:8009")
+	replicas := 0
+	for p := 0; p < rt.TotalPartitions; p++ {
+		master, held := me.PartitionsMap[p]
+		mine, _ := manager.MyResponsibility(p)
+		if mine != held {
+			t.Errorf("Partition %d, expected responsibility %t, got %t", p, held, mine)
+		}
+		if !held || master {
+			continue
+		}
+		replicas++
+		//replicas get every write, so they must accept them
+		writers, err := rt.WriteEntries(p)
+		if err != nil {
+			t.Fatalf("Error %s", err)
+		}
+		found := false
+		for _, e := range writers {
+			found = found || e.Id() == me.Id()
+		}
+		if !found {
+			t.Errorf("Partition %d, expected writes to go to the replica %s", p, me.Id())
+		}
+	}
+	if replicas == 0 {
+		t.Errorf("Expected %s to hold replicas", me.Id())
+	}
+}
@@ -0,0 +1,165 @@
+package shards
+
+import (
+	"fmt"
+	"github.com/trendrr/goshire/dynmap"
+	"sort"
+)
+
+// The phase of a partition migration
+const (
+	// The partition data is being copied from the source to the target.
+	// reads go to the source, writes go to both.
+	MIGRATION_COPYING = "copying"
+
+	// The bulk copy is done, the changes made during the copy are sent to the target
+	// (see DeltaShard).  The partition is locked for the last of the changes
+	// and while the router table is switched over.
+	MIGRATION_CATCHUP = "catchup"
+)
+
+// An in flight move of a partition from one entry to another.
+// While a migration exists the source (From) is still the owner of the partition,
+// the target (To) receives writes so it does not miss anything during the copy.
+type Migration struct {
+	Partition int
+	//entry id of the source
+	From string
+	//entry id of the target
+	To    string
+	Phase string
+}
+
+func ToMigration(mp *dynmap.DynMap) (*Migration, error) {
+	m := &Migration{}
+	var ok bool
+	m.Partition, ok = mp.GetInt("partition")
+	if !ok {
+		return nil, fmt.Errorf("No partition in migration %s", mp)
+	}
+	m.From, ok = mp.GetString("from")
+	if !ok {
+		return nil, fmt.Errorf("No from in migration %s", mp)
+	}
+	m.To, ok = mp.GetString("to")
+	if !ok {
+		return nil, fmt.Errorf("No to in migration %s", mp)
+	}
+	m.Phase = mp.MustString("phase", MIGRATION_COPYING)
+	return m, nil
+}
+
+// Translate to a DynMap of the form:
+// {
+//     "partition" : 4,
+//     "from" : "0f8fad5b-d9cb-469f-a165-70867728950e",
+//     "to" : "7c9e6679-7425-40de-944b-e07fc1f90ae7",
+//     "phase" : "copying"
+// }
+func (this *Migration) ToDynMap() *dynmap.DynMap {
+	mp := dynmap.NewDynMap()
+	mp.Put("partition", this.Partition)
+	mp.Put("from", this.From)
+	mp.Put("to", this.To)
+	mp.Put("phase", this.Phase)
+	return mp
+}
+
+// Returns the migration for this partition, if there is one
+func (this *RouterTable) Migration(partition int) (*Migration, bool) {
+	if this.Migrations == nil {
+		return nil, false
+	}
+	m, ok := this.Migrations[partition]
+	return m, ok
+}
+
+// Returns the in flight migrations sorted by partition
+func (this *RouterTable) MigrationList() []*Migration {
+	partitions := make([]int, 0, len(this.Migrations))
+	for p, _ := range this.Migrations {
+		partitions = append(partitions, p)
+	}
+	sort.Ints(partitions)
+	migrations := make([]*Migration, 0, len(partitions))
+	for _, p := range partitions {
+		migrations = append(migrations, this.Migrations[p])
+	}
+	return migrations
+}
+
+// Records a migration (or changes the phase of an existing one).
+// a new router table is returned.
+func (this *RouterTable) SetMigration(migration *Migration) (*RouterTable, error) {
+	if migration.Partition < 0 || migration.Partition >= this.TotalPartitions {
+		return nil, fmt.Errorf("Migration partition %d is out of range (%d)", migration.Partition, this.TotalPartitions)
+	}
+	//copy the router table
+	routerTable, err := this.Rebuild()
+	if err != nil {
+		return routerTable, err
+	}
+	m := *migration
+	routerTable.Migrations[m.Partition] = &m
+	routerTable.UpdateRevision()
+	return routerTable.Rebuild()
+}
+
+// Removes the migration for the partition.
+// a new router table is returned.
+func (this *RouterTable) RemoveMigration(partition int) (*RouterTable, error) {
+	//copy the router table
+	routerTable, err := this.Rebuild()
+	if err != nil {
+		return routerTable, err
+	}
+	delete(routerTable.Migrations, partition)
+	routerTable.UpdateRevision()
+	return routerTable.Rebuild()
+}
+
+// The entries reads for this partition should go to, in order of preference.
+// During a migration this is the source only.
+func (this *RouterTable) ReadEntries(partition int) ([]*RouterEntry, error) {
+	entries, err := this.PartitionEntries(partition)
+	if err != nil {
+		return entries, err
+	}
+	readers := make([]*RouterEntry, 0, len(entries))
+	for _, e := range entries {
+		if e.AcceptsReads() {
+			readers = append(readers, e)
+		}
+	}
+	return readers, nil
+}
+
+// The entries writes for this partition should go to.
+// During a migration this includes the target, so it does not miss any
+// writes made during the copy.
+func (this *RouterTable) WriteEntries(partition int) ([]*RouterEntry, error) {
+	entries, err := this.PartitionEntries(partition)
+	if err != nil {
+		return entries, err
+	}
+	writers := make([]*RouterEntry, 0, len(entries)+1)
+	for _, e := range entries {
+		if e.AcceptsWrites() {
+			writers = append(writers, e)
+		}
+	}
+	m, ok := this.Migration(partition)
+	if !ok {
+		return writers, nil
+	}
+	for _, e := range writers {
+		if e.Id() == m.To {
+			return writers, nil
+		}
+	}
+	target, ok := this.FindEntry(m.To)
+	if ok && target.EntryState() != ENTRY_DOWN {
+		writers = append(writers, target)
+	}
+	return writers, nil
+}
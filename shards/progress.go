@@ -0,0 +1,201 @@
+package shards
+
+import (
+	"fmt"
+	"github.com/trendrr/goshire/dynmap"
+	"io"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// How often PartitionImport sends a progress update
+const PROGRESS_INTERVAL = 5 * time.Second
+
+// Headers the export sets when the shard is a PartitionSizer
+const (
+	HEADER_PARTITION_SIZE    = "X-Partition-Size"
+	HEADER_PARTITION_RECORDS = "X-Partition-Records"
+)
+
+// Optional interface a Shard can implement so imports can report
+// how far along they are and how long is left.
+type PartitionSizer interface {
+	// Returns an estimate of the number of bytes ExportPartition will write for
+	// the partition, and the number of records in it.
+	PartitionSize(partition int) (bytes int64, records int64, err error)
+}
+
+// A reader that counts the bytes read through it.
+// safe to call Count from another goroutine.
+type CountingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func NewCountingReader(reader io.Reader) *CountingReader {
+	return &CountingReader{reader: reader}
+}
+
+func (this *CountingReader) Read(p []byte) (int, error) {
+	n, err := this.reader.Read(p)
+	atomic.AddInt64(&this.count, int64(n))
+	return n, err
+}
+
+func (this *CountingReader) Count() int64 {
+	return atomic.LoadInt64(&this.count)
+}
+
+// How far along a partition import is
+type TransferProgress struct {
+	Service   string
+	Partition int
+	Bytes     int64
+	//0 when the source did not report a size
+	TotalBytes int64
+	//counted when the stream is a codec record stream, otherwise estimated
+	//from the bytes when the source reported a size.  -1 when unknown
+	Records          int64
+	RecordsEstimated bool
+	//0 when the source did not report a size
+	TotalRecords int64
+	//bytes per second
+	Rate    int64
+	Elapsed time.Duration
+	//-1 when unknown
+	Eta time.Duration
+}
+
+// records is the number of records counted so far, -1 if they could not be counted.
+func NewTransferProgress(service string, partition int, bytes, records, totalBytes, totalRecords int64, elapsed time.Duration) *TransferProgress {
+	p := &TransferProgress{
+		Service:      service,
+		Partition:    partition,
+		Bytes:        bytes,
+		Records:      records,
+		TotalBytes:   totalBytes,
+		TotalRecords: totalRecords,
+		Elapsed:      elapsed,
+		Eta:          -1,
+	}
+	if elapsed > 0 {
+		p.Rate = int64(float64(bytes) / elapsed.Seconds())
+	}
+	if totalBytes > 0 {
+		fraction := float64(bytes) / float64(totalBytes)
+		if fraction > 1 {
+			fraction = 1
+		}
+		if p.Records < 0 && totalRecords > 0 {
+			p.Records = int64(fraction * float64(totalRecords))
+			p.RecordsEstimated = true
+		}
+		if p.Rate > 0 {
+			remaining := totalBytes - bytes
+			if remaining < 0 {
+				remaining = 0
+			}
+			p.Eta = time.Duration(float64(remaining) / float64(p.Rate) * float64(time.Second))
+		}
+	}
+	return p
+}
+
+// parses the size headers from an export response, 0 for any that are missing
+func partitionSizeHeaders(size, records string) (int64, int64) {
+	bytes, _ := strconv.ParseInt(size, 10, 64)
+	count, _ := strconv.ParseInt(records, 10, 64)
+	return bytes, count
+}
+
+func ToTransferProgress(mp *dynmap.DynMap) (*TransferProgress, error) {
+	p := &TransferProgress{}
+	var ok bool
+	p.Partition, ok = mp.GetInt("partition")
+	if !ok {
+		return nil, fmt.Errorf("No partition in progress %s", mp)
+	}
+	p.Bytes, ok = mp.GetInt64("bytes")
+	if !ok {
+		return nil, fmt.Errorf("No bytes in progress %s", mp)
+	}
+	p.Service = mp.MustString("service", "")
+	p.TotalBytes = mp.MustInt64("total_bytes", 0)
+	p.Records = mp.MustInt64("records", -1)
+	p.RecordsEstimated = mp.MustBool("records_estimated", false)
+	p.TotalRecords = mp.MustInt64("total_records", 0)
+	p.Rate = mp.MustInt64("rate", 0)
+	p.Elapsed = time.Duration(mp.MustInt64("elapsed", 0)) * time.Millisecond
+	p.Eta = time.Duration(mp.MustInt64("eta", -1)) * time.Millisecond
+	if p.Eta < 0 {
+		p.Eta = -1
+	}
+	return p, nil
+}
+
+// Translate to a DynMap of the form:
+// {
+//     "service" : "example",
+//     "partition" : 4,
+//     "bytes" : 104857600,
+//     "total_bytes" : 419430400,
+//     "records" : 25000, //missing when unknown
+//     "records_estimated" : true, //if records was estimated from the bytes
+//     "total_records" : 100000,
+//     "rate" : 2097152, //bytes per second
+//     "elapsed" : 50000, //millis
+//     "eta" : 150000 //millis, missing when unknown
+// }
+func (this *TransferProgress) ToDynMap() *dynmap.DynMap {
+	mp := dynmap.NewDynMap()
+	mp.Put("service", this.Service)
+	mp.Put("partition", this.Partition)
+	mp.Put("bytes", this.Bytes)
+	mp.Put("total_bytes", this.TotalBytes)
+	if this.Records >= 0 {
+		mp.Put("records", this.Records)
+		mp.Put("records_estimated", this.RecordsEstimated)
+	}
+	mp.Put("total_records", this.TotalRecords)
+	mp.Put("rate", this.Rate)
+	mp.Put("elapsed", int64(this.Elapsed/time.Millisecond))
+	if this.Eta >= 0 {
+		mp.Put("eta", int64(this.Eta/time.Millisecond))
+	}
+	return mp
+}
+
+func (this *TransferProgress) String() string {
+	str := formatBytes(this.Bytes)
+	if this.TotalBytes > 0 {
+		str = fmt.Sprintf("%s of %s (%d%%)", str, formatBytes(this.TotalBytes), this.Bytes*100/this.TotalBytes)
+	}
+	if this.Records >= 0 {
+		approx := ""
+		if this.RecordsEstimated {
+			approx = "~"
+		}
+		str = fmt.Sprintf("%s, %s%d records", str, approx, this.Records)
+		if this.TotalRecords > 0 {
+			str = fmt.Sprintf("%s of %d", str, this.TotalRecords)
+		}
+	}
+	str = fmt.Sprintf("%s, %s/s", str, formatBytes(this.Rate))
+	if this.Eta >= 0 {
+		str = fmt.Sprintf("%s, eta %s", str, this.Eta/time.Second*time.Second)
+	}
+	return str
+}
+
+func formatBytes(bytes int64) string {
+	switch {
+	case bytes >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(bytes)/(1<<30))
+	case bytes >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(bytes)/(1<<20))
+	case bytes >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(bytes)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", bytes)
+}
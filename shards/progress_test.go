@@ -0,0 +1,56 @@
+package shards
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestCountingReader(t *testing.T) {
+	reader := NewCountingReader(bytes.NewReader(make([]byte, 1234)))
+	ioutil.ReadAll(reader)
+	if reader.Count() != 1234 {
+		t.Errorf("Expected 1234 bytes, got %d", reader.Count())
+	}
+}
+
+func TestTransferProgress(t *testing.T) {
+	p := NewTransferProgress("example", 4, 100<<20, -1, 400<<20, 100000, 50*time.Second)
+	if p.Rate != 2<<20 {
+		t.Errorf("Expected 2MB/s, got %d", p.Rate)
+	}
+	if p.Records != 25000 || !p.RecordsEstimated {
+		t.Errorf("Expected about 25000 records, got %d", p.Records)
+	}
+	if p.Eta != 150*time.Second {
+		t.Errorf("Expected 150s left, got %s", p.Eta)
+	}
+
+	parsed, err := ToTransferProgress(p.ToDynMap())
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if *parsed != *p {
+		t.Errorf("Expected %v, got %v", p, parsed)
+	}
+
+	//no size from the source
+	p = NewTransferProgress("example", 4, 100<<20, -1, 0, 0, 50*time.Second)
+	if p.Eta != -1 || p.Records != -1 {
+		t.Errorf("Expected unknown eta and records, got %s %d", p.Eta, p.Records)
+	}
+	if p.ToDynMap().Exists("records") {
+		t.Errorf("Expected unknown records to be left out")
+	}
+	parsed, _ = ToTransferProgress(p.ToDynMap())
+	if parsed.Eta != -1 || parsed.Records != -1 {
+		t.Errorf("Expected unknown eta and records, got %s %d", parsed.Eta, parsed.Records)
+	}
+
+	//counted records are not estimated
+	p = NewTransferProgress("example", 4, 100<<20, 1234, 400<<20, 100000, 50*time.Second)
+	if p.Records != 1234 || p.RecordsEstimated {
+		t.Errorf("Expected 1234 counted records, got %d", p.Records)
+	}
+}
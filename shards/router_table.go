@@ -6,9 +6,48 @@ import (
 	"github.com/trendrr/goshire/dynmap"
 	"github.com/trendrr/goshire/cheshire"
 	// "log"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
+// The lifecycle state of a router entry
+const (
+	// The entry is receiving data but does not have it all yet, accepts writes only
+	ENTRY_JOINING = "joining"
+
+	// The normal state, accepts reads and writes
+	ENTRY_ACTIVE = "active"
+
+	// The entry is being emptied for maintenance, accepts reads only
+	ENTRY_DRAINING = "draining"
+
+	// The entry is unavailable, nothing should be routed to it
+	ENTRY_DOWN = "down"
+)
+
+// true if the state is one of the ENTRY_* states
+func ValidEntryState(state string) bool {
+	switch state {
+	case ENTRY_JOINING, ENTRY_ACTIVE, ENTRY_DRAINING, ENTRY_DOWN:
+		return true
+	}
+	return false
+}
+
+// true if an entry in this state accepts a request with the given method.
+// GET requests are reads, everything else is a write
+func StateAccepts(state, method string) bool {
+	if len(state) == 0 {
+		state = ENTRY_ACTIVE
+	}
+	if strings.ToUpper(method) == "GET" {
+		return state == ENTRY_ACTIVE || state == ENTRY_DRAINING
+	}
+	return state == ENTRY_ACTIVE || state == ENTRY_JOINING
+}
+
 // A router table.
 // The table is considered generally immutable.  If any changes occur a new table should
 // be generated and propagated.
@@ -19,12 +58,16 @@ type RouterTable struct {
 
 	//The revision # of the router table
 	//this should be always increasing so greater revision means more upto date router table
-	//this should typically be a timestamp
+	//this is typically a timestamp in milliseconds (see NextRevision), older tables used seconds
 	Revision int64
 
 	//total # of partitions
 	TotalPartitions int
 
+	//The revision the partitions were last split at (see Split), 0 if never.
+	//requests routed with an older table have the wrong partition numbers
+	SplitRevision int64
+
 	//Replication Factory
 	ReplicationFactor int
 
@@ -32,6 +75,13 @@ type RouterTable struct {
 	//multi key partitions will be accessed in order, separated by "|" then hashed.
 	PartitionKeys []string
 
+	//The hash algorithm used to turn a shard key into a partition
+	//see the HASH_* constants.  tables without one use md5-legacy
+	HashAlgorithm string
+
+	//In flight partition moves, by partition.  see Migration
+	Migrations map[int]*Migration
+
 	//entries organized by partition
 	//index in the array is the partition
 	EntriesPartition [][]*RouterEntry
@@ -50,6 +100,7 @@ func NewRouterTable(service string) *RouterTable {
 		Revision:          int64(0),
 		TotalPartitions:   512,
 		ReplicationFactor: 1,
+		HashAlgorithm:     HASH_MD5_LEGACY,
 	}
 }
 
@@ -58,6 +109,7 @@ func NewRouterTable(service string) *RouterTable {
 // page when we want to first test..
 func NewDefaultRouterTable(service string, conf *cheshire.ServerConfig) (*RouterTable, error) {
 	rt := NewRouterTable(service)
+	rt.HashAlgorithm = conf.MustString("shards.hash_algorithm", HASH_MD5_LEGACY)
 	//create new router entry
 	entry := dynmap.New()
 	jsonPort, ok := conf.GetInt("ports.json")
@@ -85,6 +137,7 @@ func NewDefaultRouterTable(service string, conf *cheshire.ServerConfig) (*Router
 	}
 
 	entry.Put("address", broadcastAddress)
+	entry.Put("weight", conf.MustInt("shards.weight", 1))
 
 	partitions := make([]int, 512)
 	//add all partitions
@@ -101,10 +154,46 @@ func NewDefaultRouterTable(service string, conf *cheshire.ServerConfig) (*Router
 	return rt, err
 }
 
-// updates the revision to now
+// The highest revision issued or seen by this process.
+// see NextRevision
+var revisionClock = struct {
+	lock sync.Mutex
+	last int64
+}{}
+
+// Returns a new revision that is strictly greater then the previous revision
+// and any revision this process has issued or observed.
+// Revisions are milliseconds since the epoch, unless that would not be
+// increasing, in which case we just add one.  Old tables used seconds, so
+// they always compare as older.
+func NextRevision(previous int64) int64 {
+	revisionClock.lock.Lock()
+	defer revisionClock.lock.Unlock()
+	rev := time.Now().UnixNano() / int64(time.Millisecond)
+	if rev <= previous {
+		rev = previous + 1
+	}
+	if rev <= revisionClock.last {
+		rev = revisionClock.last + 1
+	}
+	revisionClock.last = rev
+	return rev
+}
+
+// Records a revision we received from somewhere else, so any revision we
+// issue afterwards will be greater.
+func ObserveRevision(revision int64) {
+	revisionClock.lock.Lock()
+	defer revisionClock.lock.Unlock()
+	if revision > revisionClock.last {
+		revisionClock.last = revision
+	}
+}
+
+// updates the revision to now, the new revision is always greater then the previous
 func (this *RouterTable) UpdateRevision() (previous, current int64) {
 	prev := this.Revision
-	this.Revision = time.Now().Unix()
+	this.Revision = NextRevision(prev)
 	//reset the dynmap
 	this.DynMap = dynmap.NewDynMap()
 	return prev, this.Revision
@@ -128,8 +217,49 @@ func (this *RouterTable) Rebuild() (*RouterTable, error) {
 	return table, nil
 }
 
+// Creates a new table with factor times as many partitions.
+// Each partition p is split into the children p, p+total, p+2*total... all living on the
+// same entry as p.  Since partition = hash % total, every key in a child
+// used to live in its parent, so no data needs to change entries.  Replicas also
+// stay the same.
+// see PartitionSplitter
+func (this *RouterTable) Split(factor int) (*RouterTable, error) {
+	if factor < 2 {
+		return nil, fmt.Errorf("Split factor must be at least 2, got %d", factor)
+	}
+	if len(this.Migrations) > 0 {
+		return nil, fmt.Errorf("Cannot split while %d partitions are migrating", len(this.Migrations))
+	}
+	//copy the router table
+	routerTable, err := ToRouterTable(this.toDynMap())
+	if err != nil {
+		return nil, err
+	}
+	total := routerTable.TotalPartitions
+	for _, e := range routerTable.Entries {
+		partitions := make([]int, 0, len(e.Partitions)*factor)
+		for n := 0; n < factor; n++ {
+			for _, p := range e.Partitions {
+				partitions = append(partitions, p+n*total)
+			}
+		}
+		sort.Ints(partitions)
+		e.Partitions = partitions
+	}
+	routerTable.UpdateRevision()
+	routerTable.SplitRevision = routerTable.Revision
+	return routerTable.Rebuild()
+}
+
+// Checks if the partitions were split after the given revision.
+// Partition numbers (and hashed shard keys) from that revision do not match this table.
+func (this *RouterTable) SplitSince(revision int64) bool {
+	return revision < this.SplitRevision
+}
+
 // Adds one or more new entries
-// These entries will replace any entries in the current routertable.
+// These entries will replace any entries in the current routertable with the same id
+// (or the same address, for entries without a node id).
 // a new router table is returned.
 func (this *RouterTable) AddEntries(entry ...*RouterEntry) (*RouterTable, error) {
 	//copy the router table
@@ -148,6 +278,10 @@ func (this *RouterTable) AddEntries(entry ...*RouterEntry) (*RouterTable, error)
 			if e.Id() == en.Id() {
 				found = true
 			}
+			//an entry from before node ids at the same address is replaced.
+			if len(e.NodeId) == 0 && e.AddressId() == en.AddressId() {
+				found = true
+			}
 		}
 		if !found {
 			entries = append(entries, e)
@@ -202,6 +336,26 @@ func ToRouterTable(mp *dynmap.DynMap) (*RouterTable, error) {
 		//do nothing, right?
 	}
 
+	//older tables were always md5
+	t.SplitRevision = mp.MustInt64("split_revision", 0)
+	t.HashAlgorithm = mp.MustString("hash_algorithm", HASH_MD5_LEGACY)
+	_, err := NewHasher(t.HashAlgorithm)
+	if err != nil {
+		return nil, fmt.Errorf("Bad hash_algorithm in the table (%s)", err)
+	}
+
+	t.Migrations = make(map[int]*Migration)
+	migrationMaps, ok := mp.GetDynMapSlice("migrations")
+	if ok {
+		for _, m := range migrationMaps {
+			migration, err := ToMigration(m)
+			if err != nil {
+				return nil, err
+			}
+			t.Migrations[migration.Partition] = migration
+		}
+	}
+
 	//fill the entries
 	t.Entries = make([]*RouterEntry, 0)
 	entryMaps, ok := mp.GetDynMapSlice("entries")
@@ -240,15 +394,15 @@ func ToRouterTable(mp *dynmap.DynMap) (*RouterTable, error) {
 	for _, e := range t.Entries {
 
 		for _, p := range e.Partitions {
-			pRep, err := t.repPartitions(p, e)
+			reps, err := t.repEntries(p, entriesPartition)
 			if err != nil {
 				return nil, fmt.Errorf("Bad table (%s)", err)
 			}
-			entries := make([]*RouterEntry, len(pRep)+1)
+			entries := make([]*RouterEntry, len(reps)+1)
 			entries[0] = e
-			for i := 1; i < len(entries); i++ {
-				entries[i] = entriesPartition[pRep[i-1]]
-				e.PartitionsMap[pRep[i-1]] = false
+			for i, rep := range reps {
+				entries[i+1] = rep
+				rep.PartitionsMap[p] = false
 			}
 			// log.Println("EntriesPartition %p, entries %s", p, entries)
 			t.EntriesPartition[p] = entries
@@ -267,12 +421,24 @@ func (this *RouterTable) toDynMap() *dynmap.DynMap {
 	mp.Put("total_partitions", this.TotalPartitions)
 	mp.Put("replication_factor", this.ReplicationFactor)
 	mp.Put("partition_keys", this.PartitionKeys)
+	mp.Put("hash_algorithm", this.HashAlgorithm)
+	if this.SplitRevision > 0 {
+		mp.Put("split_revision", this.SplitRevision)
+	}
 
 	entries := make([]*dynmap.DynMap, 0)
 	for _, e := range this.Entries {
 		entries = append(entries, e.ToDynMap())
 	}
 	mp.Put("entries", entries)
+
+	if len(this.Migrations) > 0 {
+		migrations := make([]*dynmap.DynMap, 0)
+		for _, m := range this.MigrationList() {
+			migrations = append(migrations, m.ToDynMap())
+		}
+		mp.Put("migrations", migrations)
+	}
 	this.DynMap = mp
 	return mp
 }
@@ -282,9 +448,14 @@ func (this *RouterTable) toDynMap() *dynmap.DynMap {
 //     "service" : "trendrrdb",
 //     "revision" : 898775762309309,
 //     "total_partitions" : 256,
+//     "hash_algorithm" : "md5-legacy",
+//     "split_revision" : 898775762309000, //missing if never split
 //     "entries" : [
 //         {/*router entry 1*/},
 //         {/*router entry 2*/}
+//     ],
+//     "migrations" : [
+//         {/*migration*/}
 //     ]
 // }
 func (this *RouterTable) ToDynMap() *dynmap.DynMap {
@@ -294,54 +465,213 @@ func (this *RouterTable) ToDynMap() *dynmap.DynMap {
 	return this.toDynMap()
 }
 
-//gets the partitions that should replicate this master.
-func (this *RouterTable) repPartitions(partition int, entry *RouterEntry) ([]int, error) {
-	if true {
-		return make([]int, 0), nil
+// gets the entries that should replicate the given partition.
+// We walk the partition ring starting at the next partition and take the
+// master of each partition we pass, skipping the master of this partition
+// and any entry already chosen.  This guarantees that no entry holds two copies
+// of the same partition.  If there are fewer entries then the ReplicationFactor
+// every other entry will be returned.
+//
+// The ring is walked twice, the first pass only accepts entries in a zone
+// that does not already hold a copy, the second pass fills in any remaining
+// copies regardless of zone.
+//
+// masters is the master entry indexed by partition
+func (this *RouterTable) repEntries(partition int, masters []*RouterEntry) ([]*RouterEntry, error) {
+	entries := make([]*RouterEntry, 0)
+	if partition >= this.TotalPartitions || partition < 0 {
+		return entries, fmt.Errorf("Requested partition %d is out of bounds (%d) ", partition, this.TotalPartitions)
 	}
-	//TODO: There is something wrong with the following logic..
 
 	//This method could be much better optimized, but
 	//it is fairly rare, so we wont worry about it..
-	entries := make([]int, 0)
-	if partition >= this.TotalPartitions {
-		return entries, fmt.Errorf("Requested partition %d is out of bounds (%d) ", partition, this.TotalPartitions)
+	chosen := make(map[string]bool)
+	zones := make(map[string]bool)
+	chosen[masters[partition].Id()] = true
+	zones[masters[partition].Zone] = true
+	for pass := 0; pass < 2; pass++ {
+		for i := 1; i < this.TotalPartitions; i++ {
+			//we check if len < repfactor -1 (minus one because we still need the master)
+			if len(entries) >= this.ReplicationFactor-1 {
+				return entries, nil
+			}
+			e := masters[(i+partition)%this.TotalPartitions]
+			if e == nil || chosen[e.Id()] {
+				continue
+			}
+			if pass == 0 && zones[e.Zone] {
+				continue
+			}
+			chosen[e.Id()] = true
+			zones[e.Zone] = true
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// Returns the partitions whose copies are not spread across as many zones
+// as they could be.  An empty list means every partition is as zone safe as
+// the current entries allow.  Only zones with an entry that holds a copy of some
+// partition count, an empty entry does not make the other zones unsafe.
+func (this *RouterTable) ZoneConflicts() []int {
+	zones := make(map[string]bool)
+	for _, entries := range this.EntriesPartition {
+		for _, e := range entries {
+			zones[e.Zone] = true
+		}
 	}
 
-	for i := 1; i < this.TotalPartitions; i++ {
-		par := (i + partition) % this.TotalPartitions
-		v, ok := entry.PartitionsMap[par]
-		if ok && v {
-			//this is master.  skip to next one
-			continue
+	conflicts := make([]int, 0)
+	for p, entries := range this.EntriesPartition {
+		expected := len(entries)
+		if len(zones) < expected {
+			expected = len(zones)
+		}
+		found := make(map[string]bool)
+		for _, e := range entries {
+			found[e.Zone] = true
 		}
-		entries = append(entries, par)
-		//we check if len < repfactor -1 (minus one because we still need the current partition)
-		if len(entries) == this.ReplicationFactor-1 {
-			return entries, nil
+		if len(found) < expected {
+			conflicts = append(conflicts, p)
 		}
 	}
-	return entries, nil
+	return conflicts
+}
+
+// The number of partitions each entry should hold, proportional to its weight.
+// Returns a map of entry id to partition count.  The counts always add up to
+// TotalPartitions (remainders go to the entries with the largest fractions).
+// If every entry has weight 0 they are treated as equal.
+func (this *RouterTable) TargetPartitions() map[string]int {
+	targets := make(map[string]int)
+	if len(this.Entries) == 0 {
+		return targets
+	}
+	totalWeight := 0
+	for _, e := range this.Entries {
+		if e.Weight > 0 {
+			totalWeight += e.Weight
+		}
+	}
+
+	equal := totalWeight == 0
+	if equal {
+		totalWeight = len(this.Entries)
+	}
+	weight := func(e *RouterEntry) int {
+		if equal {
+			return 1
+		}
+		if e.Weight < 0 {
+			return 0
+		}
+		return e.Weight
+	}
+
+	assigned := 0
+	remainders := make([]int, len(this.Entries))
+	for i, e := range this.Entries {
+		share := this.TotalPartitions * weight(e)
+		targets[e.Id()] = share / totalWeight
+		remainders[i] = share % totalWeight
+		assigned += targets[e.Id()]
+	}
+	//hand out the leftovers, largest remainder first.
+	for assigned < this.TotalPartitions {
+		max := -1
+		for i, r := range remainders {
+			if r > 0 && (max < 0 || r > remainders[max]) {
+				max = i
+			}
+		}
+		if max < 0 {
+			break
+		}
+		targets[this.Entries[max].Id()]++
+		remainders[max] = 0
+		assigned++
+	}
+	return targets
+}
+
+// Builds the shard key from the request params.
+// If the shard key param (_sk) is present it is used as is, otherwise the
+// PartitionKeys are accessed in order, separated by "|".
+// returns an error if any of the partition keys are missing.
+func (this *RouterTable) ShardKey(params *dynmap.DynMap) (string, error) {
+	key, ok := params.GetString(P_SHARD_KEY)
+	if ok {
+		return key, nil
+	}
+	if len(this.PartitionKeys) == 0 {
+		return "", fmt.Errorf("No %s param, and no partition keys for service %s", P_SHARD_KEY, this.Service)
+	}
+	vals := make([]string, len(this.PartitionKeys))
+	for i, k := range this.PartitionKeys {
+		v, ok := params.GetString(k)
+		if !ok {
+			return "", fmt.Errorf("Partition key %s is missing", k)
+		}
+		vals[i] = v
+	}
+	return strings.Join(vals, "|"), nil
+}
 
+// Finds the partition for the given shard key
+// uses the hash algorithm of this table.
+func (this *RouterTable) Partition(key string) (int, error) {
+	hasher, err := NewHasher(this.HashAlgorithm)
+	if err != nil {
+		return -1, err
+	}
+	return hasher.Hash(key, this.TotalPartitions)
+}
+
+// Finds the partition from the request params.
+// see ShardKey
+func (this *RouterTable) PartitionParams(params *dynmap.DynMap) (int, error) {
+	key, err := this.ShardKey(params)
+	if err != nil {
+		return -1, err
+	}
+	return this.Partition(key)
 }
 
 // Gets the entries associated with the given partition
 // [0] should be the master entry, and there should be
 // table.ReplicationFactor number of entries
 func (this *RouterTable) PartitionEntries(partition int) ([]*RouterEntry, error) {
-	if partition >= this.TotalPartitions {
+	if partition >= this.TotalPartitions || partition < 0 {
 		return make([]*RouterEntry, 0), fmt.Errorf("Requested partition %d is out of bounds (%d) ", partition, this.TotalPartitions)
 	}
 	return this.EntriesPartition[partition], nil
 }
 
 type RouterEntry struct {
+	//The unique id of the node, generated by the node on first start.
+	//older tables will not have this.  see Id()
+	NodeId string
+
 	//The address of this entry
 	Address  string
 	JsonPort int
 	HttpPort int
 	BinPort  int
 
+	//The zone (rack or datacenter) this entry lives in.
+	//replicas are spread across zones when possible
+	Zone string
+
+	//The relative capacity of this entry.  The balancer aims for partition
+	//counts proportional to weight. 0 means the entry should hold no partitions (drain)
+	//tables without a weight default to 1
+	Weight int
+
+	//The lifecycle state of this entry, see the ENTRY_* constants.
+	//tables without a state are active
+	State string
+
 	//list of partitions this entry is responsible for (master only)
 	Partitions []int
 
@@ -359,10 +689,14 @@ func ToRouterEntry(mp *dynmap.DynMap) (*RouterEntry, error) {
 	if !ok {
 		return nil, fmt.Errorf("No Address in Entry: %s", mp)
 	}
+	e.NodeId = mp.MustString("node_id", "")
 
 	e.JsonPort = mp.MustInt("ports.json", 0)
 	e.HttpPort = mp.MustInt("ports.http", 0)
 	e.BinPort = mp.MustInt("ports.bin", 0)
+	e.Zone = mp.MustString("zone", "")
+	e.Weight = mp.MustInt("weight", 1)
+	e.State = mp.MustString("state", ENTRY_ACTIVE)
 
 	e.Partitions, ok = mp.GetIntSlice("partitions")
 	if !ok {
@@ -374,15 +708,51 @@ func ToRouterEntry(mp *dynmap.DynMap) (*RouterEntry, error) {
 	return e, nil
 }
 
-//Id for this entry.  current is address:jsonport
+//Id for this entry.  This is the NodeId, or address:jsonport for
+//entries without a node id.
 func (this *RouterEntry) Id() string {
+	if len(this.NodeId) > 0 {
+		return this.NodeId
+	}
+	return this.AddressId()
+}
+
+//address:jsonport for this entry.
+func (this *RouterEntry) AddressId() string {
 	return fmt.Sprintf("%s:%d", this.Address, this.JsonPort)
 }
 
+//The state of this entry, an empty state is active
+func (this *RouterEntry) EntryState() string {
+	if len(this.State) == 0 {
+		return ENTRY_ACTIVE
+	}
+	return this.State
+}
+
+//true if reads should be routed to this entry (active or draining)
+func (this *RouterEntry) AcceptsReads() bool {
+	return StateAccepts(this.EntryState(), "GET")
+}
+
+//true if writes should be routed to this entry (active or joining)
+func (this *RouterEntry) AcceptsWrites() bool {
+	return StateAccepts(this.EntryState(), "POST")
+}
+
+//true if a request with the given method should be routed to this entry.
+func (this *RouterEntry) Accepts(method string) bool {
+	return StateAccepts(this.EntryState(), method)
+}
+
 // Translate to a DynMap of the form:
 // {
-//     "id" : "localhost:8009"
+//     "id" : "0f8fad5b-d9cb-469f-a165-70867728950e"
+//     "node_id" : "0f8fad5b-d9cb-469f-a165-70867728950e"
 //     "address" : "localhost",
+//     "zone" : "rack1",
+//     "weight" : 1,
+//     "state" : "active",
 //     "ports" : {
 //         "json" : 8009,
 //         "http" : 8010,
@@ -393,6 +763,9 @@ func (this *RouterEntry) Id() string {
 func (this *RouterEntry) ToDynMap() *dynmap.DynMap {
 	mp := dynmap.NewDynMap()
 	mp.Put("address", this.Address)
+	if len(this.NodeId) > 0 {
+		mp.Put("node_id", this.NodeId)
+	}
 	if this.JsonPort > 0 {
 		mp.PutWithDot("ports.json", this.JsonPort)
 	}
@@ -405,6 +778,12 @@ func (this *RouterEntry) ToDynMap() *dynmap.DynMap {
 		mp.PutWithDot("ports.bin", this.BinPort)
 	}
 
+	if len(this.Zone) > 0 {
+		mp.Put("zone", this.Zone)
+	}
+	mp.Put("weight", this.Weight)
+	mp.Put("state", this.EntryState())
+
 	mp.Put("id", this.Id())
 	mp.Put("partitions", this.Partitions)
 	return mp
@@ -0,0 +1,285 @@
+package shards
+
+import (
+	"fmt"
+	"github.com/trendrr/goshire/dynmap"
+	"strings"
+)
+
+// The structured changes between two router tables.
+// see RouterTable.Diff
+type RouterTableDiff struct {
+	Service      string
+	FromRevision int64
+	ToRevision   int64
+
+	//entries that exist only in the newer table
+	Added []*RouterEntry
+	//entries that exist only in the older table
+	Removed []*RouterEntry
+
+	PortChanges []*PortChange
+
+	//zone, weight or state changes on entries that exist in both tables
+	EntryChanges []*EntryChange
+
+	//partitions whose master changed.  after a split, the children are
+	//compared to the partition they were split from
+	Moved []*PartitionMove
+
+	FromTotalPartitions int
+	ToTotalPartitions   int
+
+	FromReplicationFactor int
+	ToReplicationFactor   int
+
+	FromPartitionKeys []string
+	ToPartitionKeys   []string
+}
+
+// A port that changed on an entry that exists in both tables
+type PortChange struct {
+	EntryId string
+	//json, http or bin
+	Port string
+	From int
+	To   int
+}
+
+// A change to the zone, weight or state of an entry that exists in both tables
+type EntryChange struct {
+	EntryId string
+	//zone, weight or state
+	Field string
+	From  string
+	To    string
+}
+
+// A partition whose master changed
+type PartitionMove struct {
+	Partition int
+	From      string
+	To        string
+}
+
+// Returns the changes needed to get from this table to the other table.
+func (this *RouterTable) Diff(other *RouterTable) *RouterTableDiff {
+	diff := &RouterTableDiff{
+		Service:               other.Service,
+		FromRevision:          this.Revision,
+		ToRevision:            other.Revision,
+		Added:                 make([]*RouterEntry, 0),
+		Removed:               make([]*RouterEntry, 0),
+		PortChanges:           make([]*PortChange, 0),
+		EntryChanges:          make([]*EntryChange, 0),
+		Moved:                 make([]*PartitionMove, 0),
+		FromTotalPartitions:   this.TotalPartitions,
+		ToTotalPartitions:     other.TotalPartitions,
+		FromReplicationFactor: this.ReplicationFactor,
+		ToReplicationFactor:   other.ReplicationFactor,
+		FromPartitionKeys:     this.PartitionKeys,
+		ToPartitionKeys:       other.PartitionKeys,
+	}
+
+	for _, e := range other.Entries {
+		old, ok := this.FindEntry(e.Id())
+		if !ok {
+			diff.Added = append(diff.Added, e)
+			continue
+		}
+		diff.portChange(e.Id(), "json", old.JsonPort, e.JsonPort)
+		diff.portChange(e.Id(), "http", old.HttpPort, e.HttpPort)
+		diff.portChange(e.Id(), "bin", old.BinPort, e.BinPort)
+		diff.entryChange(e.Id(), "zone", old.Zone, e.Zone)
+		diff.entryChange(e.Id(), "weight", fmt.Sprintf("%d", old.Weight), fmt.Sprintf("%d", e.Weight))
+		diff.entryChange(e.Id(), "state", old.EntryState(), e.EntryState())
+	}
+
+	for _, e := range this.Entries {
+		if _, ok := other.FindEntry(e.Id()); !ok {
+			diff.Removed = append(diff.Removed, e)
+		}
+	}
+
+	from := this.masters()
+	to := other.masters()
+	if len(from) == 0 || len(to)%len(from) != 0 {
+		//not a split, the partitions dont line up
+		return diff
+	}
+	for p := 0; p < len(to); p++ {
+		//partition = hash % total, so a child of a split came from p % the old total
+		parent := p % len(from)
+		if from[parent] != to[p] {
+			diff.Moved = append(diff.Moved, &PartitionMove{
+				Partition: p,
+				From:      from[parent],
+				To:        to[p],
+			})
+		}
+	}
+	return diff
+}
+
+// master entry id indexed by partition
+func (this *RouterTable) masters() []string {
+	masters := make([]string, this.TotalPartitions)
+	for _, e := range this.Entries {
+		for _, p := range e.Partitions {
+			if p < len(masters) {
+				masters[p] = e.Id()
+			}
+		}
+	}
+	return masters
+}
+
+func (this *RouterTableDiff) portChange(id, port string, from, to int) {
+	if from == to {
+		return
+	}
+	this.PortChanges = append(this.PortChanges, &PortChange{
+		EntryId: id,
+		Port:    port,
+		From:    from,
+		To:      to,
+	})
+}
+
+func (this *RouterTableDiff) entryChange(id, field, from, to string) {
+	if from == to {
+		return
+	}
+	this.EntryChanges = append(this.EntryChanges, &EntryChange{
+		EntryId: id,
+		Field:   field,
+		From:    from,
+		To:      to,
+	})
+}
+
+func (this *RouterTableDiff) PartitionKeysChanged() bool {
+	return strings.Join(this.FromPartitionKeys, "|") != strings.Join(this.ToPartitionKeys, "|")
+}
+
+// true if there are no changes (other then the revision)
+func (this *RouterTableDiff) Empty() bool {
+	return len(this.Added) == 0 &&
+		len(this.Removed) == 0 &&
+		len(this.PortChanges) == 0 &&
+		len(this.EntryChanges) == 0 &&
+		len(this.Moved) == 0 &&
+		this.FromTotalPartitions == this.ToTotalPartitions &&
+		this.FromReplicationFactor == this.ToReplicationFactor &&
+		!this.PartitionKeysChanged()
+}
+
+// Human readable lines, one per change.
+func (this *RouterTableDiff) Lines() []string {
+	lines := make([]string, 0)
+	for _, e := range this.Added {
+		lines = append(lines, fmt.Sprintf("Added entry %s", e.Id()))
+	}
+	for _, e := range this.Removed {
+		lines = append(lines, fmt.Sprintf("Removed entry %s", e.Id()))
+	}
+	for _, c := range this.PortChanges {
+		lines = append(lines, fmt.Sprintf("Entry %s %s port changed %d -> %d", c.EntryId, c.Port, c.From, c.To))
+	}
+	for _, c := range this.EntryChanges {
+		lines = append(lines, fmt.Sprintf("Entry %s %s changed %s -> %s", c.EntryId, c.Field, c.From, c.To))
+	}
+	if this.FromTotalPartitions != this.ToTotalPartitions {
+		lines = append(lines, fmt.Sprintf("Total partitions changed %d -> %d", this.FromTotalPartitions, this.ToTotalPartitions))
+	}
+	for _, m := range this.Moved {
+		lines = append(lines, fmt.Sprintf("Partition %d moved %s -> %s", m.Partition, m.From, m.To))
+	}
+	if this.FromReplicationFactor != this.ToReplicationFactor {
+		lines = append(lines, fmt.Sprintf("Replication factor changed %d -> %d", this.FromReplicationFactor, this.ToReplicationFactor))
+	}
+	if this.PartitionKeysChanged() {
+		lines = append(lines, fmt.Sprintf("Partition keys changed %v -> %v", this.FromPartitionKeys, this.ToPartitionKeys))
+	}
+	return lines
+}
+
+// Translate to a DynMap of the form:
+// {
+//     "service" : "trendrrdb",
+//     "from_revision" : 898775762309309,
+//     "to_revision" : 898775762309310,
+//     "added" : [{/*router entry*/}],
+//     "removed" : [{/*router entry*/}],
+//     "port_changes" : [{"entry" : "localhost:8009", "port" : "http", "from" : 8010, "to" : 8011}],
+//     "entry_changes" : [{"entry" : "localhost:8009", "field" : "state", "from" : "active", "to" : "draining"}],
+//     "moved" : [{"partition" : 4, "from" : "localhost:8009", "to" : "localhost:8109"}],
+//     "total_partitions" : {"from" : 256, "to" : 512},
+//     "replication_factor" : {"from" : 1, "to" : 2},
+//     "partition_keys" : {"from" : ["user"], "to" : ["user", "day"]}
+// }
+// total_partitions, replication_factor and partition_keys are only included if they changed
+func (this *RouterTableDiff) ToDynMap() *dynmap.DynMap {
+	mp := dynmap.NewDynMap()
+	mp.Put("service", this.Service)
+	mp.Put("from_revision", this.FromRevision)
+	mp.Put("to_revision", this.ToRevision)
+
+	added := make([]*dynmap.DynMap, 0)
+	for _, e := range this.Added {
+		added = append(added, e.ToDynMap())
+	}
+	mp.Put("added", added)
+
+	removed := make([]*dynmap.DynMap, 0)
+	for _, e := range this.Removed {
+		removed = append(removed, e.ToDynMap())
+	}
+	mp.Put("removed", removed)
+
+	ports := make([]*dynmap.DynMap, 0)
+	for _, c := range this.PortChanges {
+		p := dynmap.NewDynMap()
+		p.Put("entry", c.EntryId)
+		p.Put("port", c.Port)
+		p.Put("from", c.From)
+		p.Put("to", c.To)
+		ports = append(ports, p)
+	}
+	mp.Put("port_changes", ports)
+
+	changes := make([]*dynmap.DynMap, 0)
+	for _, c := range this.EntryChanges {
+		p := dynmap.NewDynMap()
+		p.Put("entry", c.EntryId)
+		p.Put("field", c.Field)
+		p.Put("from", c.From)
+		p.Put("to", c.To)
+		changes = append(changes, p)
+	}
+	mp.Put("entry_changes", changes)
+
+	moved := make([]*dynmap.DynMap, 0)
+	for _, m := range this.Moved {
+		p := dynmap.NewDynMap()
+		p.Put("partition", m.Partition)
+		p.Put("from", m.From)
+		p.Put("to", m.To)
+		moved = append(moved, p)
+	}
+	mp.Put("moved", moved)
+
+	if this.FromTotalPartitions != this.ToTotalPartitions {
+		mp.PutWithDot("total_partitions.from", this.FromTotalPartitions)
+		mp.PutWithDot("total_partitions.to", this.ToTotalPartitions)
+	}
+	if this.FromReplicationFactor != this.ToReplicationFactor {
+		mp.PutWithDot("replication_factor.from", this.FromReplicationFactor)
+		mp.PutWithDot("replication_factor.to", this.ToReplicationFactor)
+	}
+	if this.PartitionKeysChanged() {
+		mp.PutWithDot("partition_keys.from", this.FromPartitionKeys)
+		mp.PutWithDot("partition_keys.to", this.ToPartitionKeys)
+	}
+	return mp
+}
@@ -1,6 +1,7 @@
 package shards
 
 import (
+	"github.com/trendrr/goshire/dynmap"
 	"testing"
 	"time"
 )
@@ -75,3 +76,574 @@ func TestPartitioning(t *testing.T) {
 	}
 
 }
+
+func TestReplicaPlacement(t *testing.T) {
+	table := NewRouterTable("testdb")
+	//more replicas then entries
+	table.ReplicationFactor = 3
+	table.Revision = time.Now().Unix()
+
+	table.Entries = append(table.Entries, &RouterEntry{
+		Address:    "entry1",
+		JsonPort:   8009,
+		HttpPort:   8010,
+		Partitions: []int{0, 1, 2},
+	})
+
+	table.Entries = append(table.Entries, &RouterEntry{
+		Address:    "entry2",
+		JsonPort:   8009,
+		HttpPort:   8010,
+		Partitions: []int{3, 4, 5},
+	})
+
+	table, err := table.Rebuild()
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+
+	for p := 0; p < table.TotalPartitions; p++ {
+		entries, err := table.PartitionEntries(p)
+		if err != nil {
+			t.Errorf("Error %s", err)
+		}
+		if len(entries) != 2 {
+			t.Errorf("partition %d should have 2 entries, has %d", p, len(entries))
+			continue
+		}
+		if entries[0].Id() == entries[1].Id() {
+			t.Errorf("partition %d has two copies on %s", p, entries[0].Id())
+		}
+		if master, ok := entries[0].PartitionsMap[p]; !ok || !master {
+			t.Errorf("partition %d should be master on %s", p, entries[0].Id())
+		}
+		if master, ok := entries[1].PartitionsMap[p]; !ok || master {
+			t.Errorf("partition %d should be replica on %s", p, entries[1].Id())
+		}
+	}
+}
+
+func TestZonePlacement(t *testing.T) {
+	table := NewRouterTable("testdb")
+	table.ReplicationFactor = 2
+	table.Revision = time.Now().Unix()
+
+	//entry1 and entry2 share a rack, so entry1's replicas should skip entry2
+	table.Entries = append(table.Entries, &RouterEntry{
+		Address:    "entry1",
+		JsonPort:   8009,
+		Zone:       "rack1",
+		Partitions: []int{0, 3},
+	})
+
+	table.Entries = append(table.Entries, &RouterEntry{
+		Address:    "entry2",
+		JsonPort:   8009,
+		Zone:       "rack1",
+		Partitions: []int{1, 4},
+	})
+
+	table.Entries = append(table.Entries, &RouterEntry{
+		Address:    "entry3",
+		JsonPort:   8009,
+		Zone:       "rack2",
+		Partitions: []int{2, 5},
+	})
+
+	table, err := table.Rebuild()
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+
+	entries, err := table.PartitionEntries(0)
+	if err != nil {
+		t.Errorf("Error %s", err)
+	}
+	if len(entries) != 2 || entries[1].Id() != "entry3:8009" {
+		t.Errorf("partition 0 should replicate to entry3 %v", entries)
+	}
+
+	conflicts := table.ZoneConflicts()
+	if len(conflicts) != 0 {
+		t.Errorf("Expected no zone conflicts, got %v", conflicts)
+	}
+
+	//round trip the zone
+	e, ok := table.FindEntry("entry3:8009")
+	if !ok || e.Zone != "rack2" {
+		t.Errorf("Zone did not survive rebuild %v", e)
+	}
+}
+
+func TestZoneConflictsEmptyEntry(t *testing.T) {
+	table := NewRouterTable("testdb")
+	table.ReplicationFactor = 2
+	table.Revision = time.Now().Unix()
+	table.TotalPartitions = 4
+	table.Entries = []*RouterEntry{
+		&RouterEntry{Address: "entry1", JsonPort: 8009, Zone: "rack1", Partitions: []int{0, 1}},
+		&RouterEntry{Address: "entry2", JsonPort: 8009, Zone: "rack1", Partitions: []int{2, 3}},
+	}
+	table, err := table.Rebuild()
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	//as spread out as a single zone allows
+	if conflicts := table.ZoneConflicts(); len(conflicts) != 0 {
+		t.Errorf("Expected no zone conflicts, got %v", conflicts)
+	}
+
+	//an entry with no partitions can not hold replicas, so its zone does not count
+	table.Entries = append(table.Entries, &RouterEntry{Address: "entry3", JsonPort: 8009, Zone: "rack2"})
+	table, err = table.Rebuild()
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if conflicts := table.ZoneConflicts(); len(conflicts) != 0 {
+		t.Errorf("Expected no zone conflicts, got %v", conflicts)
+	}
+}
+
+func TestShardKey(t *testing.T) {
+	table := NewRouterTable("testdb")
+	table.PartitionKeys = []string{"user", "day"}
+
+	params := dynmap.New()
+	params.Put("day", "2013-05-01")
+	params.Put("user", "dustin")
+	key, err := table.ShardKey(params)
+	if err != nil {
+		t.Errorf("Error %s", err)
+	}
+	if key != "dustin|2013-05-01" {
+		t.Errorf("Wrong shard key %s", key)
+	}
+
+	//explicit shard key wins
+	params.Put(P_SHARD_KEY, "explicit")
+	key, _ = table.ShardKey(params)
+	if key != "explicit" {
+		t.Errorf("Wrong shard key %s", key)
+	}
+
+	//missing partition key
+	params = dynmap.New()
+	params.Put("user", "dustin")
+	_, err = table.ShardKey(params)
+	if err == nil {
+		t.Errorf("Expected error for missing partition key")
+	}
+}
+
+func TestRevisionIncreasing(t *testing.T) {
+	table := NewRouterTable("testdb")
+	//an old style revision in seconds
+	table.Revision = time.Now().Unix()
+
+	last := table.Revision
+	for i := 0; i < 100; i++ {
+		prev, cur := table.UpdateRevision()
+		if prev != last || cur <= prev {
+			t.Fatalf("Revision did not increase %d -> %d", prev, cur)
+		}
+		last = cur
+	}
+
+	//a revision from the future (another node) must be respected
+	ObserveRevision(last + 10000)
+	_, cur := table.UpdateRevision()
+	if cur <= last+10000 {
+		t.Errorf("Revision %d should be greater then observed %d", cur, last+10000)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	table := NewRouterTable("testdb")
+	table.Revision = time.Now().Unix()
+	table.Entries = append(table.Entries, &RouterEntry{
+		Address:    "entry1",
+		JsonPort:   8009,
+		HttpPort:   8010,
+		Partitions: []int{0, 1},
+	})
+	table, err := table.Rebuild()
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+
+	e1, _ := table.FindEntry("entry1:8009")
+	moved := &RouterEntry{
+		Address:    "entry1",
+		JsonPort:   8009,
+		HttpPort:   8020,
+		Partitions: []int{0},
+	}
+	added := &RouterEntry{
+		Address:    "entry2",
+		JsonPort:   8009,
+		HttpPort:   8010,
+		Partitions: []int{1},
+	}
+	updated, err := table.AddEntries(moved, added)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if len(e1.Partitions) != 2 {
+		t.Errorf("original table should not change")
+	}
+
+	diff := table.Diff(updated)
+	if len(diff.Added) != 1 || diff.Added[0].Id() != "entry2:8009" {
+		t.Errorf("Expected entry2 added %v", diff.Added)
+	}
+	if len(diff.Removed) != 0 {
+		t.Errorf("Expected nothing removed %v", diff.Removed)
+	}
+	if len(diff.PortChanges) != 1 || diff.PortChanges[0].Port != "http" || diff.PortChanges[0].To != 8020 {
+		t.Errorf("Expected http port change %v", diff.PortChanges)
+	}
+	if len(diff.Moved) != 1 || diff.Moved[0].Partition != 1 || diff.Moved[0].To != "entry2:8009" {
+		t.Errorf("Expected partition 1 moved %v", diff.Moved)
+	}
+	if diff.Empty() {
+		t.Errorf("Diff should not be empty")
+	}
+	if !updated.Diff(updated).Empty() {
+		t.Errorf("Diff with self should be empty")
+	}
+}
+
+func TestDiffSplitAndEntryChanges(t *testing.T) {
+	table := NewRouterTable("testdb")
+	table.Revision = time.Now().Unix()
+	table.TotalPartitions = 2
+	table.Entries = []*RouterEntry{
+		&RouterEntry{Address: "entry1", JsonPort: 8009, Zone: "rack1", Partitions: []int{0}},
+		&RouterEntry{Address: "entry2", JsonPort: 8009, Zone: "rack2", Partitions: []int{1}},
+	}
+	table, err := table.Rebuild()
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+
+	split, err := table.Split(2)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	diff := table.Diff(split)
+	if diff.Empty() {
+		t.Errorf("A split should not be an empty diff")
+	}
+	if diff.FromTotalPartitions != 2 || diff.ToTotalPartitions != 4 {
+		t.Errorf("Expected total partitions 2 -> 4, got %d -> %d", diff.FromTotalPartitions, diff.ToTotalPartitions)
+	}
+	if len(diff.Moved) != 0 {
+		t.Errorf("Expected no partitions to move in a split %v", diff.Moved)
+	}
+
+	//drain entry1 and move one of its children
+	changed := &RouterEntry{Address: "entry1", JsonPort: 8009, Zone: "rack3", Weight: 0, State: ENTRY_DRAINING, Partitions: []int{0}}
+	moved := &RouterEntry{Address: "entry2", JsonPort: 8009, Zone: "rack2", Partitions: []int{1, 2, 3}}
+	drained, err := split.AddEntries(changed, moved)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	diff = table.Diff(drained)
+	if len(diff.Moved) != 1 || diff.Moved[0].Partition != 2 || diff.Moved[0].From != "entry1:8009" || diff.Moved[0].To != "entry2:8009" {
+		t.Errorf("Expected partition 2 moved from entry1 to entry2 %v", diff.Moved)
+	}
+	fields := make(map[string]*EntryChange)
+	for _, c := range diff.EntryChanges {
+		if c.EntryId != "entry1:8009" {
+			t.Errorf("Unexpected change %v", c)
+		}
+		fields[c.Field] = c
+	}
+	if c, ok := fields["state"]; !ok || c.From != ENTRY_ACTIVE || c.To != ENTRY_DRAINING {
+		t.Errorf("Expected a state change %v", diff.EntryChanges)
+	}
+	if c, ok := fields["zone"]; !ok || c.From != "rack1" || c.To != "rack3" {
+		t.Errorf("Expected a zone change %v", diff.EntryChanges)
+	}
+}
+
+func TestTargetPartitions(t *testing.T) {
+	table := NewRouterTable("testdb")
+	table.TotalPartitions = 10
+	table.Entries = []*RouterEntry{
+		&RouterEntry{Address: "big", JsonPort: 8009, Weight: 3},
+		&RouterEntry{Address: "small", JsonPort: 8009, Weight: 1},
+		&RouterEntry{Address: "drain", JsonPort: 8009, Weight: 0},
+	}
+	targets := table.TargetPartitions()
+	if targets["big:8009"] != 8 || targets["small:8009"] != 2 || targets["drain:8009"] != 0 {
+		t.Errorf("Bad targets %v", targets)
+	}
+
+	//all drained is treated as equal
+	for _, e := range table.Entries {
+		e.Weight = 0
+	}
+	targets = table.TargetPartitions()
+	total := 0
+	for _, v := range targets {
+		if v < 3 || v > 4 {
+			t.Errorf("Bad targets %v", targets)
+		}
+		total += v
+	}
+	if total != 10 {
+		t.Errorf("Targets should add up to 10 %v", targets)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	table := NewRouterTable("testdb")
+	table.ReplicationFactor = 2
+	table.Revision = time.Now().Unix()
+	table.Entries = append(table.Entries, &RouterEntry{
+		Address:    "entry1",
+		JsonPort:   8009,
+		Partitions: []int{0, 2},
+	})
+	table.Entries = append(table.Entries, &RouterEntry{
+		Address:    "entry2",
+		JsonPort:   8009,
+		Partitions: []int{1, 3},
+	})
+	table, err := table.Rebuild()
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+
+	split, err := table.Split(2)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if split.TotalPartitions != 8 || split.Revision <= table.Revision {
+		t.Errorf("Bad split table %d partitions, revision %d", split.TotalPartitions, split.Revision)
+	}
+
+	for p := 0; p < split.TotalPartitions; p++ {
+		parent, _ := table.PartitionEntries(p % table.TotalPartitions)
+		child, _ := split.PartitionEntries(p)
+		if len(parent) != len(child) {
+			t.Fatalf("partition %d has %d entries, parent has %d", p, len(child), len(parent))
+		}
+		for i := range parent {
+			if parent[i].Id() != child[i].Id() {
+				t.Errorf("partition %d entry %d is %s, parent is %s", p, i, child[i].Id(), parent[i].Id())
+			}
+		}
+	}
+
+	//keys hash into a child of their old partition
+	for _, key := range []string{"a", "b", "dustin", "trendrr"} {
+		old, _ := table.Partition(key)
+		p, _ := split.Partition(key)
+		if p%table.TotalPartitions != old {
+			t.Errorf("key %s moved from %d to %d", key, old, p)
+		}
+	}
+
+	//requests routed with the old table are from before the split
+	if split.SplitRevision != split.Revision {
+		t.Errorf("split revision is %d, expected %d", split.SplitRevision, split.Revision)
+	}
+	if !split.SplitSince(table.Revision) || split.SplitSince(split.Revision) {
+		t.Errorf("SplitSince is wrong for revisions %d and %d", table.Revision, split.Revision)
+	}
+	parsed, err := ToRouterTable(split.ToDynMap())
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if parsed.SplitRevision != split.SplitRevision {
+		t.Errorf("split revision %d did not survive parsing, got %d", split.SplitRevision, parsed.SplitRevision)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	table := NewRouterTable("testdb")
+	table.TotalPartitions = 4
+	table.ReplicationFactor = 3
+	table.Entries = []*RouterEntry{
+		&RouterEntry{Address: "entry1", JsonPort: 8009, HttpPort: 8010, BinPort: 8011, Partitions: []int{0, 1}},
+		&RouterEntry{Address: "entry2", JsonPort: 8009, HttpPort: 8010, Partitions: []int{1, 2}},
+	}
+	problems := table.Validate()
+	if !HasErrors(problems) {
+		t.Fatalf("Expected errors %v", problems)
+	}
+	expected := map[string]bool{
+		"error: Entry entry2:8009 has no bin port":                              false,
+		"error: Partition 1 is on both entry1:8009 and entry2:8009":             false,
+		"error: 1 partitions have no entry [3]":                                 false,
+		"warning: Replication factor 3 is greater then the number of entries 2": false,
+	}
+	for _, p := range problems {
+		if _, ok := expected[p.String()]; ok {
+			expected[p.String()] = true
+		}
+	}
+	for k, found := range expected {
+		if !found {
+			t.Errorf("Expected problem %s in %v", k, problems)
+		}
+	}
+
+	table.ReplicationFactor = 1
+	table.Entries[1].BinPort = 8011
+	table.Entries[1].Partitions = []int{2, 3}
+	problems = table.Validate()
+	if len(problems) != 0 {
+		t.Errorf("Expected no problems %v", problems)
+	}
+}
+
+func TestFindMyEntry(t *testing.T) {
+	table := NewRouterTable("testdb")
+	table.Entries = []*RouterEntry{
+		&RouterEntry{NodeId: "node-1", Address: "10.0.0.1", JsonPort: 8009},
+		&RouterEntry{Address: "10.0.0.2", JsonPort: 8009},
+		&RouterEntry{Address: "127.0.0.1", JsonPort: 8109},
+	}
+	local := map[string]bool{"127.0.0.1": true}
+
+	e, _ := FindMyEntry(table, "node-1", "somewhere:8009", local)
+	if e == nil || e.NodeId != "node-1" {
+		t.Errorf("Expected to find by node id, got %v", e)
+	}
+	e, _ = FindMyEntry(table, "node-2", "10.0.0.2:8009", local)
+	if e == nil || e.Address != "10.0.0.2" {
+		t.Errorf("Expected to find by address, got %v", e)
+	}
+	//the broadcast address doesnt match, but the interface does
+	e, _ = FindMyEntry(table, "node-2", "public.example:8109", local)
+	if e == nil || e.Address != "127.0.0.1" {
+		t.Errorf("Expected to find by local address, got %v", e)
+	}
+	//the entry with another nodes id is never a candidate
+	e, candidates := FindMyEntry(table, "node-2", "public.example:9999", local)
+	if e != nil {
+		t.Errorf("Expected not to find an entry, got %v", e)
+	}
+	if len(candidates) != 2 {
+		t.Errorf("Expected 2 candidates, got %d", len(candidates))
+	}
+}
+
+func TestEntryStates(t *testing.T) {
+	table := NewRouterTable("testdb")
+	table.TotalPartitions = 2
+	table.ReplicationFactor = 2
+	table.Entries = []*RouterEntry{
+		&RouterEntry{Address: "entry1", JsonPort: 8009, HttpPort: 8010, BinPort: 8011, State: ENTRY_DOWN, Partitions: []int{0}},
+		&RouterEntry{Address: "entry2", JsonPort: 8009, HttpPort: 8010, BinPort: 8011, State: ENTRY_DRAINING, Partitions: []int{1}},
+	}
+	table, err := table.Rebuild()
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if table.Entries[0].State != ENTRY_DOWN {
+		t.Errorf("Expected state to survive a rebuild, got %s", table.Entries[0].State)
+	}
+
+	//partition 0 master is down, so reads go to the draining replica
+	readers, _ := table.ReadEntries(0)
+	if len(readers) != 1 || readers[0].Address != "entry2" {
+		t.Errorf("Expected partition 0 reads to go to entry2, got %v", readers)
+	}
+	if writers, _ := table.WriteEntries(0); len(writers) != 0 {
+		t.Errorf("Expected no entry accepting writes, got %v", writers)
+	}
+	e := readers[0]
+	if !e.Accepts("GET") || e.Accepts("POST") {
+		t.Errorf("Expected draining entry to accept reads only")
+	}
+
+	problems := table.Validate()
+	found := false
+	for _, p := range problems {
+		if p.String() == "warning: 2 partitions have no entry accepting writes [0 1]" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected a write warning in %v", problems)
+	}
+
+	table.Entries[1].State = ENTRY_DOWN
+	if readers, _ := table.ReadEntries(1); len(readers) != 0 {
+		t.Errorf("Expected no route when every entry is down, got %v", readers)
+	}
+	table.Entries[1].State = "sleeping"
+	if !HasErrors(table.Validate()) {
+		t.Errorf("Expected an error for an unknown state")
+	}
+}
+
+func TestMigrations(t *testing.T) {
+	table := NewRouterTable("testdb")
+	table.Entries = []*RouterEntry{
+		&RouterEntry{Address: "entry1", JsonPort: 8009, HttpPort: 8010, BinPort: 8011, Partitions: []int{0, 1}},
+		&RouterEntry{Address: "entry2", JsonPort: 8009, HttpPort: 8010, BinPort: 8011, Partitions: []int{2, 3}},
+	}
+	table, err := table.Rebuild()
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	table, err = table.SetMigration(&Migration{Partition: 1, From: "entry1:8009", To: "entry2:8009", Phase: MIGRATION_COPYING})
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if len(table.Validate()) != 0 {
+		t.Errorf("Expected no problems %v", table.Validate())
+	}
+
+	//survives serialization
+	table, err = ToRouterTable(table.ToDynMap())
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	m, ok := table.Migration(1)
+	if !ok || m.To != "entry2:8009" || m.Phase != MIGRATION_COPYING {
+		t.Fatalf("Expected migration of partition 1, got %v", m)
+	}
+
+	reads, _ := table.ReadEntries(1)
+	if len(reads) != 1 || reads[0].Address != "entry1" {
+		t.Errorf("Expected reads from entry1 only, got %v", reads)
+	}
+	writes, _ := table.WriteEntries(1)
+	if len(writes) != 2 || writes[1].Address != "entry2" {
+		t.Errorf("Expected writes to entry1 and entry2, got %v", writes)
+	}
+	writes, _ = table.WriteEntries(0)
+	if len(writes) != 1 {
+		t.Errorf("Expected writes to entry1 only, got %v", writes)
+	}
+
+	if _, err := table.Split(2); err == nil {
+		t.Errorf("Expected split to fail during a migration")
+	}
+
+	table, err = table.SetMigration(&Migration{Partition: 2, From: "entry1:8009", To: "entry3:8009", Phase: MIGRATION_COPYING})
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if !HasErrors(table.Validate()) {
+		t.Errorf("Expected errors for a migration with the wrong source and target")
+	}
+
+	table, err = table.RemoveMigration(2)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	table, err = table.RemoveMigration(1)
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	if len(table.Migrations) != 0 {
+		t.Errorf("Expected no migrations, got %v", table.MigrationList())
+	}
+}
@@ -0,0 +1,201 @@
+package shards
+
+import (
+	"fmt"
+	"github.com/trendrr/goshire/dynmap"
+)
+
+// Severity of a router table problem
+const (
+	// The table should not be used
+	SEVERITY_ERROR = "error"
+
+	// The table is usable, but probably not what you want
+	SEVERITY_WARNING = "warning"
+)
+
+// A single problem found by RouterTable.Validate
+type Problem struct {
+	Severity string
+	Message  string
+}
+
+func (this *Problem) String() string {
+	return fmt.Sprintf("%s: %s", this.Severity, this.Message)
+}
+
+func (this *Problem) ToDynMap() *dynmap.DynMap {
+	mp := dynmap.NewDynMap()
+	mp.Put("severity", this.Severity)
+	mp.Put("message", this.Message)
+	return mp
+}
+
+// true if any of the problems are errors
+func HasErrors(problems []*Problem) bool {
+	for _, p := range problems {
+		if p.Severity == SEVERITY_ERROR {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns an error listing every error level problem, or nil if there are none.
+func ProblemsError(problems []*Problem) error {
+	if !HasErrors(problems) {
+		return nil
+	}
+	msg := "Invalid router table"
+	for _, p := range problems {
+		if p.Severity == SEVERITY_ERROR {
+			msg = fmt.Sprintf("%s; %s", msg, p.Message)
+		}
+	}
+	return fmt.Errorf("%s", msg)
+}
+
+// Checks the table for every problem we know about.
+// returns an empty list if the table is fine.
+func (this *RouterTable) Validate() []*Problem {
+	problems := make([]*Problem, 0)
+	add := func(severity, format string, args ...interface{}) {
+		problems = append(problems, &Problem{
+			Severity: severity,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	if len(this.Service) == 0 {
+		add(SEVERITY_ERROR, "No service name")
+	}
+	if this.TotalPartitions <= 0 {
+		add(SEVERITY_ERROR, "Total partitions must be greater then 0")
+	}
+	if this.ReplicationFactor < 1 {
+		add(SEVERITY_ERROR, "Replication factor must be at least 1")
+	}
+	if _, err := NewHasher(this.HashAlgorithm); err != nil {
+		add(SEVERITY_ERROR, "%s", err)
+	}
+
+	if len(this.Entries) == 0 {
+		add(SEVERITY_WARNING, "Table has no entries")
+		return problems
+	}
+
+	if this.ReplicationFactor > len(this.Entries) {
+		add(SEVERITY_WARNING, "Replication factor %d is greater then the number of entries %d", this.ReplicationFactor, len(this.Entries))
+	}
+
+	ids := make(map[string]bool)
+	owners := make(map[int]string)
+	for _, e := range this.Entries {
+		if ids[e.Id()] {
+			add(SEVERITY_ERROR, "Duplicate entry %s", e.Id())
+		}
+		ids[e.Id()] = true
+
+		if len(e.Address) == 0 {
+			add(SEVERITY_ERROR, "Entry %s has no address", e.Id())
+		}
+		if e.JsonPort <= 0 {
+			add(SEVERITY_ERROR, "Entry %s has no json port", e.Id())
+		}
+		if e.HttpPort <= 0 {
+			add(SEVERITY_ERROR, "Entry %s has no http port", e.Id())
+		}
+		if e.BinPort <= 0 {
+			add(SEVERITY_ERROR, "Entry %s has no bin port", e.Id())
+		}
+		if e.Weight < 0 {
+			add(SEVERITY_ERROR, "Entry %s has a negative weight", e.Id())
+		}
+		if !ValidEntryState(e.EntryState()) {
+			add(SEVERITY_ERROR, "Entry %s has unknown state %s", e.Id(), e.State)
+		}
+
+		for _, p := range e.Partitions {
+			if p < 0 || p >= this.TotalPartitions {
+				add(SEVERITY_ERROR, "Entry %s has partition %d out of range (%d)", e.Id(), p, this.TotalPartitions)
+				continue
+			}
+			if owner, ok := owners[p]; ok {
+				add(SEVERITY_ERROR, "Partition %d is on both %s and %s", p, owner, e.Id())
+				continue
+			}
+			owners[p] = e.Id()
+		}
+	}
+
+	missing := make([]int, 0)
+	for p := 0; p < this.TotalPartitions; p++ {
+		if _, ok := owners[p]; !ok {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) > 0 {
+		add(SEVERITY_ERROR, "%d partitions have no entry %v", len(missing), missing)
+	}
+
+	unreadable := make([]int, 0)
+	unwritable := make([]int, 0)
+	for p, entries := range this.EntriesPartition {
+		reads, writes := false, false
+		for _, e := range entries {
+			reads = reads || e.AcceptsReads()
+			writes = writes || e.AcceptsWrites()
+		}
+		if !reads {
+			unreadable = append(unreadable, p)
+		}
+		if !writes {
+			unwritable = append(unwritable, p)
+		}
+	}
+	if len(unreadable) > 0 {
+		add(SEVERITY_WARNING, "%d partitions have no entry accepting reads %v", len(unreadable), unreadable)
+	}
+	if len(unwritable) > 0 {
+		add(SEVERITY_WARNING, "%d partitions have no entry accepting writes %v", len(unwritable), unwritable)
+	}
+
+	for _, m := range this.MigrationList() {
+		if m.Partition < 0 || m.Partition >= this.TotalPartitions {
+			add(SEVERITY_ERROR, "Migration of partition %d is out of range (%d)", m.Partition, this.TotalPartitions)
+			continue
+		}
+		if owners[m.Partition] != m.From {
+			add(SEVERITY_ERROR, "Migration of partition %d is from %s, but %s is the master", m.Partition, m.From, owners[m.Partition])
+		}
+		if !ids[m.To] {
+			add(SEVERITY_ERROR, "Migration of partition %d is to unknown entry %s", m.Partition, m.To)
+		}
+		if m.From == m.To {
+			add(SEVERITY_ERROR, "Migration of partition %d is to the same entry %s", m.Partition, m.To)
+		}
+		if m.Phase != MIGRATION_COPYING && m.Phase != MIGRATION_CATCHUP {
+			add(SEVERITY_ERROR, "Migration of partition %d has unknown phase %s", m.Partition, m.Phase)
+		}
+	}
+
+	conflicts := this.ZoneConflicts()
+	if len(conflicts) > 0 {
+		add(SEVERITY_WARNING, "%d partitions could not be spread across zones %v", len(conflicts), conflicts)
+	}
+	return problems
+}
+
+// Parses and validates the router table.
+// Problems that stop the table from parsing are returned as errors
+// along with a nil table.
+func ValidateDynMap(mp *dynmap.DynMap) (*RouterTable, []*Problem) {
+	rt, err := ToRouterTable(mp)
+	if err != nil {
+		return nil, []*Problem{&Problem{
+			Severity: SEVERITY_ERROR,
+			Message:  fmt.Sprintf("%s", err),
+		}}
+	}
+	return rt, rt.Validate()
+}
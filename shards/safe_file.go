@@ -0,0 +1,124 @@
+package shards
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// The number of older copies kept by WriteFileSafe for router tables
+const DEFAULT_GENERATIONS = 5
+
+// Writes the file so that a crash never leaves a partial file behind.
+// The data is written to a temp file, synced, and renamed over filename.
+// The previous contents are kept as filename.1 (the one before that as filename.2 and so on)
+// up to generations copies.
+func WriteFileSafe(filename string, data []byte, generations int) error {
+	tmp := filename + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	//shift the generations, oldest falls off the end
+	for i := generations; i > 0; i-- {
+		from := generationFilename(filename, i-1)
+		_, err := os.Stat(from)
+		if err != nil {
+			continue
+		}
+		if i == 1 {
+			//keep the current file in place until the rename, so there is always a file.
+			err = copyFile(from, generationFilename(filename, 1))
+		} else {
+			err = os.Rename(from, generationFilename(filename, i))
+		}
+		if err != nil {
+			log.Printf("Unable to keep generation %d of %s (%s)", i, filename, err)
+		}
+	}
+
+	err = os.Rename(tmp, filename)
+	if err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(filename))
+	return nil
+}
+
+// Reads the newest generation of the file that passes the valid check.
+// see WriteFileSafe
+func ReadFileSafe(filename string, generations int, valid func([]byte) error) ([]byte, error) {
+	var firstErr error
+	for i := 0; i <= generations; i++ {
+		name := generationFilename(filename, i)
+		bytes, err := ioutil.ReadFile(name)
+		if err == nil {
+			err = valid(bytes)
+		}
+		if err == nil {
+			if i > 0 {
+				log.Printf("WARNING %s is damaged (%s), using %s instead", filename, firstErr, name)
+			}
+			return bytes, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if i > 0 && os.IsNotExist(err) {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+func generationFilename(filename string, generation int) string {
+	if generation == 0 {
+		return filename
+	}
+	return fmt.Sprintf("%s.%d", filename, generation)
+}
+
+func copyFile(from, to string) error {
+	bytes, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(bytes)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncs the directory so the rename is durable.  Not all platforms support this.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
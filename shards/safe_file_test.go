@@ -0,0 +1,60 @@
+package shards
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileSafe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shards-safe")
+	if err != nil {
+		t.Fatalf("Error %s", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "test.routertable")
+
+	for i := 1; i <= 4; i++ {
+		err = WriteFileSafe(filename, []byte(fmt.Sprintf("version %d", i)), 2)
+		if err != nil {
+			t.Fatalf("Error %s", err)
+		}
+	}
+	expected := map[string]string{
+		filename:        "version 4",
+		filename + ".1": "version 3",
+		filename + ".2": "version 2",
+	}
+	for name, contents := range expected {
+		bytes, err := ioutil.ReadFile(name)
+		if err != nil || string(bytes) != contents {
+			t.Errorf("Expected %s to contain %s, got %s (%s)", name, contents, bytes, err)
+		}
+	}
+	if _, err := os.Stat(filename + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 generations")
+	}
+	if _, err := os.Stat(filename + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Expected the temp file to be gone")
+	}
+
+	//a truncated current file falls back to the previous generation
+	ioutil.WriteFile(filename, []byte("vers"), 0644)
+	valid := func(bytes []byte) error {
+		if len(bytes) < len("version 0") {
+			return fmt.Errorf("truncated")
+		}
+		return nil
+	}
+	bytes, err := ReadFileSafe(filename, 2, valid)
+	if err != nil || string(bytes) != "version 3" {
+		t.Errorf("Expected version 3, got %s (%s)", bytes, err)
+	}
+
+	_, err = ReadFileSafe(filepath.Join(dir, "missing"), 2, valid)
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected a not exist error, got %s", err)
+	}
+}
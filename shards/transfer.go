@@ -0,0 +1,120 @@
+package shards
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/golang/snappy"
+	"io"
+	"strings"
+	"time"
+)
+
+// Compressions for partition transfers.
+// negotiated with the Accept-Encoding and Content-Encoding headers on the export request
+const (
+	COMPRESSION_NONE   = ""
+	COMPRESSION_GZIP   = "gzip"
+	COMPRESSION_SNAPPY = "snappy"
+)
+
+func ValidCompression(compression string) bool {
+	switch compression {
+	case COMPRESSION_NONE, COMPRESSION_GZIP, COMPRESSION_SNAPPY:
+		return true
+	}
+	return false
+}
+
+// Picks the first compression we support from an Accept-Encoding header.
+// returns COMPRESSION_NONE if there is none.
+func NegotiateCompression(acceptEncoding string) string {
+	for _, enc := range strings.Split(acceptEncoding, ",") {
+		//ignore any quality values, we go in the order given
+		enc = strings.TrimSpace(strings.SplitN(enc, ";", 2)[0])
+		enc = strings.ToLower(enc)
+		if enc != COMPRESSION_NONE && ValidCompression(enc) {
+			return enc
+		}
+	}
+	return COMPRESSION_NONE
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (this nopWriteCloser) Close() error {
+	return nil
+}
+
+// Wraps the writer to compress everything written.
+// Close must be called to flush the compressor, it does not close the writer.
+func CompressWriter(writer io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case COMPRESSION_NONE:
+		return nopWriteCloser{writer}, nil
+	case COMPRESSION_GZIP:
+		return gzip.NewWriterLevel(writer, gzip.BestSpeed)
+	case COMPRESSION_SNAPPY:
+		return snappy.NewBufferedWriter(writer), nil
+	}
+	return nil, fmt.Errorf("Unknown compression %s", compression)
+}
+
+// Wraps the reader to decompress a stream written by CompressWriter
+func DecompressReader(reader io.Reader, compression string) (io.Reader, error) {
+	switch compression {
+	case COMPRESSION_NONE:
+		return reader, nil
+	case COMPRESSION_GZIP:
+		return gzip.NewReader(reader)
+	case COMPRESSION_SNAPPY:
+		return snappy.NewReader(reader), nil
+	}
+	return nil, fmt.Errorf("Unknown compression %s", compression)
+}
+
+// A reader that reads no faster then Rate bytes per second.
+// The import side of a transfer reads through this, tcp backpressure slows the export side.
+type ThrottledReader struct {
+	reader io.Reader
+	//bytes per second
+	Rate    int64
+	started time.Time
+	read    int64
+}
+
+// Throttles the reader to rate bytes per second.  0 or less means unlimited.
+func NewThrottledReader(reader io.Reader, rate int64) io.Reader {
+	if rate <= 0 {
+		return reader
+	}
+	return &ThrottledReader{
+		reader: reader,
+		Rate:   rate,
+	}
+}
+
+func (this *ThrottledReader) Read(p []byte) (int, error) {
+	if this.started.IsZero() {
+		this.started = time.Now()
+	}
+	//read in small enough chunks that we sleep about 10 times a second
+	chunk := this.Rate / 10
+	if chunk < 1 {
+		chunk = 1
+	}
+	if int64(len(p)) > chunk {
+		p = p[:chunk]
+	}
+	n, err := this.reader.Read(p)
+	this.read += int64(n)
+
+	//sleep until we are back under the rate
+	expected := time.Duration(float64(this.read) / float64(this.Rate) * float64(time.Second))
+	elapsed := time.Since(this.started)
+	if expected > elapsed {
+		time.Sleep(expected - elapsed)
+	}
+	return n, err
+}
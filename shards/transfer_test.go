@@ -0,0 +1,65 @@
+package shards
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestNegotiateCompression(t *testing.T) {
+	cases := map[string]string{
+		"":                    COMPRESSION_NONE,
+		"gzip":                COMPRESSION_GZIP,
+		"snappy, gzip":        COMPRESSION_SNAPPY,
+		"deflate, GZIP;q=0.5": COMPRESSION_GZIP,
+		"deflate, br":         COMPRESSION_NONE,
+	}
+	for header, expected := range cases {
+		if c := NegotiateCompression(header); c != expected {
+			t.Errorf("Expected '%s' for '%s', got '%s'", expected, header, c)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	data := bytes.Repeat([]byte("partition data "), 1000)
+	for _, compression := range []string{COMPRESSION_NONE, COMPRESSION_GZIP, COMPRESSION_SNAPPY} {
+		var buf bytes.Buffer
+		writer, err := CompressWriter(&buf, compression)
+		if err != nil {
+			t.Fatalf("Error %s", err)
+		}
+		writer.Write(data)
+		err = writer.Close()
+		if err != nil {
+			t.Fatalf("Error %s", err)
+		}
+		if compression != COMPRESSION_NONE && buf.Len() >= len(data) {
+			t.Errorf("Expected %s to compress, got %d bytes", compression, buf.Len())
+		}
+		reader, err := DecompressReader(&buf, compression)
+		if err != nil {
+			t.Fatalf("Error %s", err)
+		}
+		result, err := ioutil.ReadAll(reader)
+		if err != nil || !bytes.Equal(result, data) {
+			t.Errorf("Expected %s to round trip (%v)", compression, err)
+		}
+	}
+	if _, err := CompressWriter(&bytes.Buffer{}, "lzma"); err == nil {
+		t.Errorf("Expected an error for an unknown compression")
+	}
+}
+
+func TestThrottledReader(t *testing.T) {
+	data := make([]byte, 3000)
+	start := time.Now()
+	result, err := ioutil.ReadAll(NewThrottledReader(bytes.NewReader(data), 10000))
+	if err != nil || len(result) != len(data) {
+		t.Fatalf("Expected to read %d bytes, got %d (%v)", len(data), len(result), err)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("Expected 3000 bytes at 10000 bytes/sec to take about 300ms, took %s", elapsed)
+	}
+}